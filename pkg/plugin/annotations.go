@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Annotation queries mark the periods where an aggregation crossed a threshold, and
+// the changes seen in filter definitions. Definitions carry no history, so changes are
+// the ones observed between two fetches of this instance, kept in memory and stamped
+// with the time of the fetch that saw them. They are lost on restart and differ
+// between Grafana instances, the annotation text says so.
+
+const (
+	annotationsQueryType = "annotations"
+	conditionAbove       = "above"
+	conditionBelow       = "below"
+)
+
+// AnnotationQuery is the model of an annotations query. The embedded query picks the
+// aggregation compared to Threshold, it is not run when Threshold is not set.
+type AnnotationQuery struct {
+	QueryOptions
+	Threshold null.Float `json:"threshold"`
+	// Condition is above (the default) or below the threshold.
+	Condition string `json:"condition"`
+	// DefinitionChanges adds the changes of the filter definition, of every
+	// definition when the query has no filter.
+	DefinitionChanges bool `json:"definitionChanges"`
+}
+
+// annotation is a single row of the annotations frame.
+type annotation struct {
+	time    time.Time
+	timeEnd time.Time
+	text    string
+	tags    []string
+}
+
+// definitionChangeNote tells readers of a definition change annotation how little its
+// time means.
+const definitionChangeNote = "Seen when this Grafana instance refetched the definitions, the change may be older."
+
+// definitionChange is a change seen in a filter definition.
+type definitionChange struct {
+	FilterId string
+	Name     string
+	Time     time.Time
+	Changes  []string
+}
+
+// QueryAnnotations answers annotations queries with a frame of time, timeEnd, text and
+// tags per query.
+func (d *handler) QueryAnnotations(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	response := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		var aq AnnotationQuery
+		if err := json.Unmarshal(q.JSON, &aq); err != nil {
+			response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid annotation query: %s", err.Error()))
+			continue
+		}
+		if aq.Condition == "" {
+			aq.Condition = conditionAbove
+		}
+		if aq.Condition != conditionAbove && aq.Condition != conditionBelow {
+			response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid condition %q", aq.Condition))
+			continue
+		}
+
+		var annotations []annotation
+		if aq.Threshold.Valid && aq.FilterId != "" {
+			found, err := d.thresholdAnnotations(ctx, req.PluginContext, q, aq)
+			if err != nil {
+				response.Responses[q.RefID] = backend.DataResponse{Error: err}
+				continue
+			}
+			annotations = append(annotations, found...)
+		}
+		if aq.DefinitionChanges {
+			changes := d.filterDefs.definitionChanges(apiToken(req.PluginContext))
+			annotations = append(annotations, changeAnnotations(changes, aq.FilterId, q.TimeRange)...)
+		}
+		frame := annotationFrame(annotations)
+		frame.RefID = q.RefID
+		response.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{frame}}
+	}
+	return response, nil
+}
+
+// thresholdAnnotations runs the query of aq as a long frame and returns an annotation
+// per run of points crossing the threshold, per grouping.
+func (d *handler) thresholdAnnotations(ctx context.Context, pluginCtx backend.PluginContext, q backend.DataQuery, aq AnnotationQuery) ([]annotation, error) {
+	qo := aq.QueryOptions
+	qo.LongResult = null.BoolFrom(true)
+	qo.Format = ""
+	qo.Instant = false
+	qo.Hide = null.Bool{}
+	query, err := json.Marshal(qo)
+	if err != nil {
+		return nil, err
+	}
+	q.JSON = query
+	q.QueryType = ""
+	resp, err := d.QueryData(ctx, &backend.QueryDataRequest{PluginContext: pluginCtx, Queries: []backend.DataQuery{q}})
+	if err != nil {
+		return nil, err
+	}
+	res := resp.Responses[q.RefID]
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	var annotations []annotation
+	for _, frame := range res.Frames {
+		annotations = append(annotations, crossings(frame, aq)...)
+	}
+	return annotations, nil
+}
+
+// crossings finds the runs of consecutive points of a long frame beyond the threshold
+// of aq. A run ends at its last point beyond the threshold. Queries of several series
+// are compared on their last one.
+func crossings(frame *data.Frame, aq AnnotationQuery) []annotation {
+	if len(frame.Fields) < 2 || frame.Fields[0].Type() != data.FieldTypeTime {
+		return nil
+	}
+	times := frame.Fields[0]
+	var groupings data.Fields
+	for _, f := range frame.Fields[1 : len(frame.Fields)-1] {
+		if f.Type().NonNullableType() == data.FieldTypeString {
+			groupings = append(groupings, f)
+		}
+	}
+	value := frame.Fields[len(frame.Fields)-1]
+	threshold := aq.Threshold.Float64
+	beyond := func(v float64) bool {
+		if aq.Condition == conditionBelow {
+			return v < threshold
+		}
+		return v > threshold
+	}
+
+	type run struct {
+		annotation
+		peak float64
+	}
+	type series struct {
+		values []string
+		rows   []int
+	}
+	var all []*series
+	index := make(map[string]*series)
+	for r := 0; r < frame.Rows(); r++ {
+		values := make([]string, len(groupings))
+		for k, g := range groupings {
+			if v, ok := g.ConcreteAt(r); ok {
+				values[k], _ = v.(string)
+			}
+		}
+		id := strings.Join(values, "\x00")
+		s, ok := index[id]
+		if !ok {
+			s = &series{values: values}
+			index[id] = s
+			all = append(all, s)
+		}
+		s.rows = append(s.rows, r)
+	}
+
+	name := value.Name
+	if value.Config != nil && value.Config.DisplayNameFromDS != "" {
+		name = value.Config.DisplayNameFromDS
+	}
+	var annotations []annotation
+	for _, s := range all {
+		slices.SortStableFunc(s.rows, func(a, b int) int {
+			return times.At(a).(time.Time).Compare(times.At(b).(time.Time))
+		})
+		var labels, tags []string
+		tags = append(tags, "threshold")
+		for k, g := range groupings {
+			labels = append(labels, g.Name+"="+s.values[k])
+			tags = append(tags, g.Name+":"+s.values[k])
+		}
+		var current *run
+		flush := func() {
+			if current == nil {
+				return
+			}
+			text := fmt.Sprintf("%s %s %s, peak %s", name, aq.Condition, formatValue(threshold), formatValue(current.peak))
+			if len(labels) > 0 {
+				text += " (" + strings.Join(labels, ", ") + ")"
+			}
+			current.text = text
+			annotations = append(annotations, current.annotation)
+			current = nil
+		}
+		for _, r := range s.rows {
+			p, err := value.NullableFloatAt(r)
+			if err != nil || p == nil || !beyond(*p) {
+				flush()
+				continue
+			}
+			v := *p
+			t := times.At(r).(time.Time)
+			if current == nil {
+				current = &run{annotation: annotation{time: t, tags: tags}, peak: v}
+			}
+			current.timeEnd = t
+			if aq.Condition == conditionBelow && v < current.peak || aq.Condition == conditionAbove && v > current.peak {
+				current.peak = v
+			}
+		}
+		flush()
+	}
+	return annotations
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// changeAnnotations returns the changes of filterId, of every filter when empty,
+// seen within tr.
+func changeAnnotations(changes []definitionChange, filterId string, tr backend.TimeRange) []annotation {
+	var annotations []annotation
+	for _, c := range changes {
+		if filterId != "" && c.FilterId != filterId || c.Time.Before(tr.From) || c.Time.After(tr.To) {
+			continue
+		}
+		annotations = append(annotations, annotation{
+			time:    c.Time,
+			timeEnd: c.Time,
+			text:    fmt.Sprintf("Filter definition %s: %s\n%s", c.Name, strings.Join(c.Changes, ", "), definitionChangeNote),
+			tags:    []string{"definition", c.Name},
+		})
+	}
+	return annotations
+}
+
+// annotationFrame returns annotations sorted by time as a frame Grafana overlays on
+// panels.
+func annotationFrame(annotations []annotation) *data.Frame {
+	sort.SliceStable(annotations, func(i, j int) bool { return annotations[i].time.Before(annotations[j].time) })
+	times := make([]time.Time, len(annotations))
+	ends := make([]time.Time, len(annotations))
+	texts := make([]string, len(annotations))
+	tags := make([]json.RawMessage, len(annotations))
+	for i, a := range annotations {
+		times[i], ends[i], texts[i] = a.time, a.timeEnd, a.text
+		tags[i], _ = json.Marshal(a.tags)
+	}
+	frame := data.NewFrame("Annotations",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, ends),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+	)
+	frame.Meta = &data.FrameMeta{}
+	return frame
+}
+
+// diffFilterDefinitions returns the changes between two fetches of the definitions,
+// observed at now.
+func diffFilterDefinitions(prev []FilterDefinition, next []FilterDefinition, now time.Time) []definitionChange {
+	var changes []definitionChange
+	for i := range next {
+		fd := &next[i]
+		old := findFilterDefinition(prev, fd.FilterId)
+		var what []string
+		if old == nil {
+			what = []string{"created"}
+		} else {
+			what = diffFilterDefinition(old, fd)
+		}
+		if len(what) > 0 {
+			changes = append(changes, definitionChange{FilterId: fd.FilterId, Name: fd.Name, Time: now, Changes: what})
+		}
+	}
+	for i := range prev {
+		if findFilterDefinition(next, prev[i].FilterId) == nil {
+			changes = append(changes, definitionChange{FilterId: prev[i].FilterId, Name: prev[i].Name, Time: now, Changes: []string{"deleted"}})
+		}
+	}
+	return changes
+}
+
+// diffFilterDefinition describes what changed from old to fd.
+func diffFilterDefinition(old *FilterDefinition, fd *FilterDefinition) []string {
+	var what []string
+	if old.Name != fd.Name {
+		what = append(what, fmt.Sprintf("renamed from %s", old.Name))
+	}
+	if old.Filter != fd.Filter {
+		what = append(what, "filter updated")
+	}
+	if !reflect.DeepEqual(old.Groupings, fd.Groupings) || !reflect.DeepEqual(old.GroupingItems, fd.GroupingItems) {
+		what = append(what, "groupings updated")
+	}
+	for _, agg := range fd.Aggregations {
+		prev := old.Aggregation(int(agg.Id))
+		if prev == nil {
+			what = append(what, fmt.Sprintf("aggregation %s added", agg.Name))
+		} else if !reflect.DeepEqual(*prev, agg) {
+			what = append(what, fmt.Sprintf("aggregation %s updated", agg.Name))
+		}
+	}
+	for _, agg := range old.Aggregations {
+		if fd.Aggregation(int(agg.Id)) == nil {
+			what = append(what, fmt.Sprintf("aggregation %s removed", agg.Name))
+		}
+	}
+	return what
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func annotationRows(t *testing.T, frame *data.Frame) []annotation {
+	t.Helper()
+	if len(frame.Fields) != 4 || frame.Fields[0].Name != "time" || frame.Fields[1].Name != "timeEnd" || frame.Fields[2].Name != "text" || frame.Fields[3].Name != "tags" {
+		t.Fatalf("unexpected annotation fields %s", frameTable(frame))
+	}
+	rows := make([]annotation, frame.Rows())
+	for i := range rows {
+		rows[i] = annotation{
+			time:    frame.Fields[0].At(i).(time.Time),
+			timeEnd: frame.Fields[1].At(i).(time.Time),
+			text:    frame.Fields[2].At(i).(string),
+		}
+		if err := json.Unmarshal(frame.Fields[3].At(i).(json.RawMessage), &rows[i].tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rows
+}
+
+func TestQueryAnnotationsThreshold(t *testing.T) {
+	srv, _ := apiServer(serveMetrics(`[
+{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":"ios","country":"US"},"queryId":"A"},
+{"dtSecLater":0,"val":1,"queryId":"A"},
+{"dtSecLater":60,"val":5,"queryId":"A"},
+{"dtSecLater":120,"val":6,"queryId":"A"},
+{"dtSecLater":180,"val":2,"queryId":"A"},
+{"dtSecLater":240,"val":7,"queryId":"A"},
+{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":"android","country":"US"},"queryId":"A"},
+{"dtSecLater":0,"val":3,"queryId":"A"}
+]`))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp, err := ds.QueryAnnotations(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID:     "A",
+		QueryType: annotationsQueryType,
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","format":"multi","threshold":4}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil || len(res.Frames) != 1 {
+		t.Fatalf("got %v", res)
+	}
+	rows := annotationRows(t, res.Frames[0])
+	if len(rows) != 2 {
+		t.Fatalf("expected a period per run above the threshold, got %v", rows)
+	}
+	if !rows[0].time.Equal(from.Add(time.Minute)) || !rows[0].timeEnd.Equal(from.Add(2*time.Minute)) {
+		t.Errorf("got the first period %v - %v", rows[0].time, rows[0].timeEnd)
+	}
+	if rows[0].text != "Logins above 4, peak 6 (os=ios, country=US)" {
+		t.Errorf("got text %q", rows[0].text)
+	}
+	if strings.Join(rows[0].tags, ",") != "threshold,os:ios,country:US" {
+		t.Errorf("got tags %v", rows[0].tags)
+	}
+	if !rows[1].time.Equal(from.Add(4*time.Minute)) || !rows[1].timeEnd.Equal(rows[1].time) {
+		t.Errorf("got the second period %v - %v", rows[1].time, rows[1].timeEnd)
+	}
+
+	resp, _ = ds.QueryAnnotations(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","threshold":4,"condition":"equal"}`),
+	}}})
+	if resp.Responses["A"].Error == nil {
+		t.Error("expected an unknown condition to be refused")
+	}
+}
+
+func TestQueryAnnotationsDefinitionChanges(t *testing.T) {
+	for _, cacheSeconds := range []string{"60", "-1"} {
+		t.Run("cache "+cacheSeconds, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Write([]byte(testFilterDefinitions))
+					return
+				}
+				w.Write([]byte(strings.Replace(testFilterDefinitions, `"name":"Failed"`, `"name":"Failures"`, 1)))
+			}))
+			defer srv.Close()
+			ds := newTestHandlerWithSettings(t, `{"baseUrl":"`+srv.URL+`","filterDefinitionCacheSeconds":`+cacheSeconds+`}`)
+
+			pluginCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"apiKey": "token"}}}
+			before := time.Now()
+			for range 2 {
+				ds.filterDefs.invalidate("token")
+				if _, err := ds.filterDefinitions(context.Background(), "token"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := calls.Load(); n != 2 {
+				t.Fatalf("expected two fetches, got %d", n)
+			}
+
+			query := func(json string) []annotation {
+				resp, err := ds.QueryAnnotations(context.Background(), &backend.QueryDataRequest{PluginContext: pluginCtx, Queries: []backend.DataQuery{{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: before, To: time.Now()},
+					JSON:      []byte(json),
+				}}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Responses["A"].Error != nil {
+					t.Fatal(resp.Responses["A"].Error)
+				}
+				return annotationRows(t, resp.Responses["A"].Frames[0])
+			}
+			rows := query(`{"filterId":"f","definitionChanges":true}`)
+			if len(rows) != 1 || rows[0].text != "Filter definition Logins: aggregation Failures updated\n"+definitionChangeNote {
+				t.Fatalf("expected the aggregation update, got %v", rows)
+			}
+			if strings.Join(rows[0].tags, ",") != "definition,Logins" {
+				t.Errorf("got tags %v", rows[0].tags)
+			}
+			if rows := query(`{"filterId":"other","definitionChanges":true}`); len(rows) != 0 {
+				t.Errorf("expected the changes of other filters to be left out, got %v", rows)
+			}
+		})
+	}
+}
+
+func TestDiffFilterDefinitions(t *testing.T) {
+	var prev, next []FilterDefinition
+	json.Unmarshal([]byte(testFilterDefinitions), &prev)
+	json.Unmarshal([]byte(testFilterDefinitions), &next)
+	next[0].Filter = "event == 'login'"
+	next[0].Aggregations = next[0].Aggregations[:1]
+	next = append(next, FilterDefinition{FilterId: "g", Name: "Signups"})
+
+	changes := diffFilterDefinitions(prev, next, time.Now())
+	if len(changes) != 2 {
+		t.Fatalf("got %+v", changes)
+	}
+	if got := strings.Join(changes[0].Changes, ", "); got != "filter updated, aggregation Failed removed" {
+		t.Errorf("got %q", got)
+	}
+	if changes[1].FilterId != "g" || changes[1].Changes[0] != "created" {
+		t.Errorf("got %+v", changes[1])
+	}
+	if changes := diffFilterDefinitions(prev, prev, time.Now()); len(changes) != 0 {
+		t.Errorf("expected no change, got %+v", changes)
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryBatch is a set of queries sent to metrics/results in a single call.
+type queryBatch struct {
+	Queries []QueryOptions
+	// NumQueries is the number of queries combined for the panel, see queryMulti.
+	NumQueries int
+	// Reason tells why the queries ended up in this batch, for the query inspector.
+	Reason string
+}
+
+// batchCompatibility is what queries must share to be sent in the same call.
+type batchCompatibility struct {
+	StartTime string
+	EndTime   string
+	Interval  int64
+}
+
+func compatibility(qo QueryOptions) batchCompatibility {
+	c := batchCompatibility{StartTime: qo.StartTime, EndTime: qo.EndTime}
+	if qo.RecalculatedInterval != nil {
+		c.Interval = qo.RecalculatedInterval.Frequency
+	}
+	return c
+}
+
+// planBatches groups fast mode queries by time range and recalculated interval and
+// splits the groups into batches of at most maxSize queries. Batches keep the order in
+// which their first query was asked for. num_queries is the number of queries combined
+// for the panel, including duplicates that are not sent.
+func planBatches(qos []QueryOptions, num_queries int, maxSize int) []queryBatch {
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchSize
+	}
+	var order []batchCompatibility
+	groups := make(map[batchCompatibility][]QueryOptions)
+	for _, qo := range qos {
+		c := compatibility(qo)
+		if _, ok := groups[c]; !ok {
+			order = append(order, c)
+		}
+		groups[c] = append(groups[c], qo)
+	}
+
+	var batches []queryBatch
+	for _, c := range order {
+		group := groups[c]
+		reason := fmt.Sprintf("same time range %s to %s", c.StartTime, c.EndTime)
+		if c.Interval > 0 {
+			reason += fmt.Sprintf(", recalculated every %ds", c.Interval)
+		}
+		if len(order) > 1 {
+			reason += fmt.Sprintf(", split from %d other time ranges", len(order)-1)
+		}
+		for start := 0; start < len(group); start += maxSize {
+			end := min(start+maxSize, len(group))
+			batch_reason := reason
+			if len(group) > maxSize {
+				batch_reason += fmt.Sprintf(", capped at %d queries", maxSize)
+			}
+			batches = append(batches, queryBatch{Queries: group[start:end], NumQueries: num_queries, Reason: batch_reason})
+		}
+	}
+	return batches
+}
+
+// runBatch runs a planned batch. When the combined call is rejected, the batch is
+// bisected until the queries causing the failure are isolated, so the healthy ones
+// still render and only the bad ones report the error. Every call waits for a slot.
+func (d *handler) runBatch(ctx context.Context, token string, pluginCtx backend.PluginContext, batch queryBatch, index int, total int) map[string]*backend.DataResponse {
+	response, err := d.queryInSlot(ctx, token, pluginCtx, batch.Queries, batch.NumQueries)
+	note := ""
+	if d.shouldBisect(ctx, batch.Queries, err) {
+		var calls int
+		response, calls = d.bisect(ctx, token, pluginCtx, batch.Queries, batch.NumQueries)
+		note = fmt.Sprintf("combined call failed (%s), bisected in %d more calls", err, calls)
+	}
+	for _, r := range response {
+		updateMeta(r.Frames, func(meta *data.FrameMeta) {
+			meta.ExecutedQueryString = batch.describe(index, total, note)
+		})
+	}
+	return response
+}
+
+// shouldBisect reports whether the failure of qos may be caused by some of them only.
+// Only statuses pointing at a bad query are worth splitting the batch for. Server
+// errors were already retried, splitting would only add load to a struggling API.
+func (d *handler) shouldBisect(ctx context.Context, qos []QueryOptions, err error) bool {
+	if err == nil || len(qos) < 2 || ctx.Err() != nil {
+		return false
+	}
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// queryInSlot runs queryMulti once a slot is free, the queries get the context error
+// when the request is cancelled before.
+func (d *handler) queryInSlot(ctx context.Context, token string, pluginCtx backend.PluginContext, qos []QueryOptions, num_queries int) (map[string]*backend.DataResponse, error) {
+	var response map[string]*backend.DataResponse
+	var err error
+	if slot_err := d.withSlot(ctx, func() { response, err = d.queryMulti(ctx, token, pluginCtx, qos, num_queries) }); slot_err != nil {
+		response = make(map[string]*backend.DataResponse, len(qos))
+		for _, qo := range qos {
+			response[qo.QueryId] = &backend.DataResponse{Error: slot_err}
+		}
+		return response, slot_err
+	}
+	return response, err
+}
+
+// bisect runs both halves of qos concurrently, each in its own slot, and bisects a half
+// again when it fails. It returns the responses and the number of upstream calls it made.
+func (d *handler) bisect(ctx context.Context, token string, pluginCtx backend.PluginContext, qos []QueryOptions, num_queries int) (map[string]*backend.DataResponse, int) {
+	mid := len(qos) / 2
+	halves := [][]QueryOptions{qos[:mid], qos[mid:]}
+	responses := make([]map[string]*backend.DataResponse, len(halves))
+	calls := make([]int, len(halves))
+	var wg sync.WaitGroup
+	for i, half := range halves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := d.queryInSlot(ctx, token, pluginCtx, half, num_queries)
+			calls[i] = 1
+			if d.shouldBisect(ctx, half, err) {
+				var n int
+				res, n = d.bisect(ctx, token, pluginCtx, half, num_queries)
+				calls[i] += n
+			}
+			responses[i] = res
+		}()
+	}
+	wg.Wait()
+
+	response := make(map[string]*backend.DataResponse, len(qos))
+	total := 0
+	for i, res := range responses {
+		for id, r := range res {
+			response[id] = r
+		}
+		total += calls[i]
+	}
+	return response, total
+}
+
+// describe explains the planner decision in the executed query string of the frames.
+func (b queryBatch) describe(index int, total int, note string) string {
+	ids := make([]string, len(b.Queries))
+	for i, qo := range b.Queries {
+		ids[i] = qo.QueryId
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "POST metrics/results?multi=true\nbatch %d of %d: %s\nreason: %s", index+1, total, strings.Join(ids, ", "), b.Reason)
+	if note != "" {
+		sb.WriteString("\n")
+		sb.WriteString(note)
+	}
+	return sb.String()
+}
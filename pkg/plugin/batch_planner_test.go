@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestPlanBatches(t *testing.T) {
+	qo := func(id string, start string) QueryOptions {
+		return QueryOptions{QueryId: id, StartTime: start, EndTime: "2024-01-02T00:00:00Z"}
+	}
+	batches := planBatches([]QueryOptions{
+		qo("A", "2024-01-01T00:00:00Z"),
+		qo("B", "2024-01-01T12:00:00Z"),
+		qo("C", "2024-01-01T00:00:00Z"),
+		qo("D", "2024-01-01T00:00:00Z"),
+	}, 4, 2)
+
+	var got []string
+	for _, b := range batches {
+		var ids []string
+		for _, q := range b.Queries {
+			ids = append(ids, q.QueryId)
+		}
+		got = append(got, strings.Join(ids, ","))
+		if b.NumQueries != 4 {
+			t.Errorf("expected the batch to know about all 4 queries, got %d", b.NumQueries)
+		}
+	}
+	if want := "A,C|D|B"; strings.Join(got, "|") != want {
+		t.Errorf("got batches %q, want %q", strings.Join(got, "|"), want)
+	}
+}
+
+func TestQueryDataBatchBisection(t *testing.T) {
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		for _, qo := range qos {
+			if qo.QueryId == "B" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("bad query"))
+				return
+			}
+		}
+		w.Write([]byte(testMetrics))
+	})
+	defer srv.Close()
+
+	resp, err := newTestHandler(t, srv.URL).QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "X", JSON: []byte(`{`)},
+			{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","fast_mode":true}`)},
+			{RefID: "B", JSON: []byte(`{"filterId":"f","aggregationId":2,"calculation":"COUNT","fast_mode":true,"limit":3}`)},
+			{RefID: "C", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"AVG","fast_mode":true}`)},
+			{RefID: "D", JSON: []byte(`{"filterId":"f","aggregationId":2,"calculation":"COUNT","fast_mode":true,"alias":"D"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["X"].Error == nil {
+		t.Error("X: expected the unmarshal error")
+	}
+	if resp.Responses["B"].Error == nil {
+		t.Error("B: expected the upstream error")
+	}
+	for _, refID := range []string{"C", "D"} {
+		if err := resp.Responses[refID].Error; err != nil {
+			t.Errorf("%s: expected no error, got %v", refID, err)
+		}
+	}
+	a := resp.Responses["A"]
+	if a.Error != nil || len(a.Frames) == 0 {
+		t.Fatalf("A: expected data after the fallback, got %v", a.Error)
+	}
+	if executed := a.Frames[0].Meta.ExecutedQueryString; !strings.Contains(executed, "bisected in 4 more calls") {
+		t.Errorf("A: expected the bisection in the executed query string, got %q", executed)
+	}
+}
+
+func TestQueryDataBatchBisectionSlots(t *testing.T) {
+	for _, limit := range []int32{1, 2} {
+		var running, maxRunning atomic.Int32
+		srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+			var qos []QueryOptions
+			json.NewDecoder(r.Body).Decode(&qos)
+			if len(qos) > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(testMetrics))
+		})
+		ds := newTestHandlerWithSettings(t, `{"baseUrl":"`+srv.URL+`","maxConcurrentQueries":`+strconv.Itoa(int(limit))+`}`)
+
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","fast_mode":true}`)},
+				{RefID: "B", JSON: []byte(`{"filterId":"f","aggregationId":2,"calculation":"COUNT","fast_mode":true}`)},
+			},
+		})
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, refID := range []string{"A", "B"} {
+			if err := resp.Responses[refID].Error; err != nil {
+				t.Errorf("limit %d, %s: expected no error, got %v", limit, refID, err)
+			}
+		}
+		if m := maxRunning.Load(); m != limit {
+			t.Errorf("expected the halves to run %d at a time, got %d", limit, m)
+		}
+	}
+}
+
+func TestQueryDataFastModeAfterInvalidQuery(t *testing.T) {
+	srv, calls := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+
+	resp, err := newTestHandler(t, srv.URL).QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "X", JSON: []byte(`not json`)},
+			{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","fast_mode":true}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["X"].Error == nil {
+		t.Error("X: expected the unmarshal error")
+	}
+	if a := resp.Responses["A"]; a.Error != nil || len(a.Frames) == 0 {
+		t.Errorf("A: expected data, got %v", a.Error)
+	}
+	if n := callCount(calls, "/api/v1/metrics/results"); n != 1 {
+		t.Errorf("expected a single combined call, got %d", n)
+	}
+}
+
+func TestQueryDataBatchServerError(t *testing.T) {
+	srv, calls := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	var queries []backend.DataQuery
+	for i, refID := range []string{"A", "B", "C", "D"} {
+		queries = append(queries, backend.DataQuery{RefID: refID, JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","fast_mode":true,"alias":"` + strconv.Itoa(i) + `"}`)})
+	}
+	resp, err := newTestHandlerWithSettings(t, `{"baseUrl":"`+srv.URL+`","maxRetries":0}`).QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if resp.Responses[q.RefID].Error == nil {
+			t.Errorf("%s: expected the upstream error", q.RefID)
+		}
+	}
+	if n := callCount(calls, "/api/v1/metrics/results"); n != 1 {
+		t.Errorf("expected server errors not to be bisected, got %d calls", n)
+	}
+}
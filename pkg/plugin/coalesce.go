@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	resultsRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "aggregations_io",
+		Name:      "results_requests_total",
+		Help:      "Number of metrics/results calls needed by queries, including coalesced ones.",
+	})
+	resultsRequestsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "aggregations_io",
+		Name:      "results_requests_coalesced_total",
+		Help:      "Number of metrics/results calls that shared an identical call already in flight.",
+	})
+)
+
+// coalescedCall is an upstream call shared by every caller asking for the same thing
+// while it is in flight.
+type coalescedCall struct {
+	done    chan struct{}
+	res     map[string]*queryResult
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// coalescer shares in-flight metrics/results calls between concurrent requests, e.g.
+// everybody opening the same dashboard. A shared call only gets cancelled once all
+// its callers gave up. The zero value is ready to use.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do runs fn for key unless an identical call is in flight, in which case it waits for
+// that call's result. shared reports whether the result came from another caller's
+// call. The result is shared and must not be modified.
+func (c *coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (map[string]*queryResult, error)) (res map[string]*queryResult, shared bool, err error) {
+	resultsRequests.Inc()
+
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	call, shared := c.calls[key]
+	if shared {
+		call.waiters++
+		resultsRequestsCoalesced.Inc()
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		c.calls[key] = call
+		go func() {
+			defer cancel()
+			call.res, call.err = fn(callCtx)
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.res, shared, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// coalesceKey identifies a metrics/results call by token and payload.
+func coalesceKey(token string, payload []byte) string {
+	h := sha256.New()
+	h.Write([]byte(token))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -1,17 +1,17 @@
 package handler
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/ahmetb/go-linq/v3"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
@@ -34,18 +34,30 @@ var (
 type handler struct {
 	instanceManager instancemgmt.InstanceManager
 	settings        backend.DataSourceInstanceSettings
+	config          DatasourceSettings
 	resourceHandler backend.CallResourceHandler
 	httpClient      *http.Client
+	filterDefs      filterDefinitionCache
+	results         resultCache
+	series          resultCache
+	slotsOnce       sync.Once
+	slotsCh         chan struct{}
+	inflight        coalescer
+	streams         streamHub
 }
 
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	opts, err := settings.HTTPClientOptions(ctx)
-	opts.Timeouts.Timeout = 10 * time.Second
-	opts.Header.Add("X-IS_GRAFANA", "1")
+	config, err := LoadSettings(settings)
+	if err != nil {
+		return nil, fmt.Errorf("datasource settings: %w", err)
+	}
 
+	opts, err := settings.HTTPClientOptions(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("http client options: %w", err)
 	}
+	opts.Timeouts.Timeout = config.Timeout()
+	opts.Header.Add("X-IS_GRAFANA", "1")
 
 	// Uncomment the following to forward all HTTP headers in the requests made by the client
 	// (disabled by default since SDK v0.161.0)
@@ -66,20 +78,24 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 
 	h := &handler{
 		settings:   settings,
+		config:     config,
 		httpClient: cl,
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/filterDefinitions", h.GetFilterDefinitions)
+	mux.HandleFunc("/filterDefinitions/invalidate", h.InvalidateFilterDefinitions)
 	// QueryDataHandler
 	queryTypeMux := datasource.NewQueryTypeMux()
 	queryTypeMux.HandleFunc("query", h.QueryData)
 	queryTypeMux.HandleFunc("", h.QueryData)
+	queryTypeMux.HandleFunc(annotationsQueryType, h.QueryAnnotations)
 
 	return datasource.ServeOpts{
 		CheckHealthHandler:  h,
 		CallResourceHandler: httpadapter.New(mux),
 		QueryDataHandler:    queryTypeMux,
+		StreamHandler:       h,
 	}, nil
 
 }
@@ -93,7 +109,7 @@ var DatasourceOpts = datasource.ManageOpts{}
 func (d *handler) Dispose() {
 	// Clean up datasource instance resources.
 	d.httpClient.CloseIdleConnections()
-
+	d.streams.close()
 }
 
 type qos_return struct {
@@ -102,6 +118,7 @@ type qos_return struct {
 	qo       *QueryOptions
 	is_valid bool
 	err      error
+	expr     *expressionQuery
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -110,93 +127,104 @@ type qos_return struct {
 // contains Frames ([]*Frame).
 func (d *handler) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	// create response struct
-	api_token := req.PluginContext.DataSourceInstanceSettings.DecryptedSecureJSONData["apiKey"]
+	api_token := apiToken(req.PluginContext)
 
 	response := backend.NewQueryDataResponse()
 
 	// loop over queries and execute them individually.
 
-	var qos []qos_return
-
-	linq.From(req.Queries).Select(func(q interface{}) interface{} {
+	qos := make([]qos_return, len(req.Queries))
+	for i, q := range req.Queries {
 		var this_qo QueryOptions
-		err := json.Unmarshal(q.(backend.DataQuery).JSON, &this_qo)
+		err := json.Unmarshal(q.JSON, &this_qo)
 		var ret qos_return
 		ret.err = err
+		ret.q = q
 		if err == nil {
-			this_qo.StartTime = q.(backend.DataQuery).TimeRange.From.UTC().Format(time.RFC3339)
-			this_qo.EndTime = q.(backend.DataQuery).TimeRange.To.UTC().Format(time.RFC3339)
+			this_qo.StartTime = q.TimeRange.From.UTC().Format(time.RFC3339)
+			this_qo.EndTime = q.TimeRange.To.UTC().Format(time.RFC3339)
 			ret.had_err = false
-			this_qo.QueryId = (q.(backend.DataQuery).RefID)
+			this_qo.QueryId = q.RefID
+			this_qo.resolveGroupingFilters()
+			this_qo.Interval = q.Interval
 			this_qo.Optimized = true
 			if this_qo.ShouldRecalculate {
-				this_qo.RecalculatedInterval = &RecalculateInterval{Type: "SECOND", Frequency: int64(q.(backend.DataQuery).Interval.Abs().Seconds())}
+				this_qo.RecalculatedInterval = &RecalculateInterval{Type: "SECOND", Frequency: int64(q.Interval.Abs().Seconds())}
+			}
+			if this_qo.Instant && this_qo.Reducer == "" {
+				// the API aggregates the whole range, in more than one interval when it
+				// doesn't line up with them
+				this_qo.RecalculatedInterval = &RecalculateInterval{Type: "SECOND", Frequency: int64(q.TimeRange.Duration().Seconds())}
 			}
 
-			ret.q = q.(backend.DataQuery)
 			ret.qo = &this_qo
 
-			ret.is_valid = !(this_qo.FilterId == "" || (this_qo.Calculation == PERCENTILES && (!this_qo.Percentile.Valid || this_qo.Percentile.Float64 <= 0 || this_qo.Percentile.Float64 > 1)))
+			ret.is_valid = this_qo.FilterId != "" && validPercentiles(this_qo)
 			if this_qo.Mode == "variables" {
 				ret.is_valid = ret.is_valid && this_qo.SpecificGrouping != ""
 			}
+			switch this_qo.Format {
+			case "", formatMulti, formatNumeric:
+			default:
+				ret.is_valid = false
+				ret.err = fmt.Errorf("Invalid Query %q: unknown format %q", q.RefID, this_qo.Format)
+			}
+			if !validReducer(this_qo.Reducer) {
+				ret.is_valid = false
+				ret.err = fmt.Errorf("Invalid Query %q: unknown reducer %q", q.RefID, this_qo.Reducer)
+			}
+			if this_qo.Mode == ratioMode {
+				if err := validRatio(this_qo); err != nil {
+					ret.is_valid = false
+					ret.err = fmt.Errorf("Invalid Query %q: %w", q.RefID, err)
+				}
+			}
+			if this_qo.Mode == expressionMode {
+				node, refs, err := parseExpression(this_qo.Expression)
+				ret.is_valid = err == nil
+				if err != nil {
+					ret.err = fmt.Errorf("Invalid Query %q: %w", q.RefID, err)
+				} else {
+					ret.expr = &expressionQuery{qo: this_qo, node: node, refs: refs}
+				}
+			}
 		} else {
 			ret.had_err = true
 
 		}
-		return ret
-	}).ToSlice(&qos)
-
-	var ok_ct = 0
-	for q := range qos {
-		if !qos[q].had_err && qos[q].is_valid {
-			ok_ct++
-		}
+		qos[i] = ret
 	}
 
-	fast_mode := qos[0].qo.FastMode
-
-	var indiv []qos_return
-	if fast_mode {
-		var to_combine []QueryOptions
-
+	// hidden queries still run when an expression refers to them, their responses are
+	// blanked once the expressions are evaluated
+	var hidden_refs []string
+	for changed := true; changed; {
+		changed = false
 		for q := range qos {
-			var this_q = qos[q]
-			if this_q.had_err {
-				response.Responses[this_q.q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", this_q.err.Error()))
-			} else if this_q.qo.Hide.Bool {
-				var blank_response backend.DataResponse
-				response.Responses[this_q.q.RefID] = blank_response
-			} else if !this_q.is_valid {
-				var blank_response backend.DataResponse
-				if this_q.qo.FilterId != "" {
-					blank_response.Error = fmt.Errorf("Invalid Query %q", this_q.q.RefID)
-				}
-				response.Responses[this_q.q.RefID] = blank_response
-			} else {
-				if this_q.qo.Mode == "variables" {
-					indiv = append(indiv, this_q)
-				} else {
-
-					to_combine = append(to_combine, *this_q.qo)
-				}
+			if qos[q].expr == nil || qos[q].qo.Hide.Bool {
+				continue
 			}
-		}
-
-		if len(to_combine) > 0 {
-			var fres = d.queryMulti(ctx, api_token, req.PluginContext, to_combine)
-			for id, resp := range fres {
-				//backend.Logger.Info(fmt.Sprintf("Got %s - %d rows", id, len(resp.Frames)))
-				response.Responses[id] = *resp
+			for r := range qos {
+				if !qos[r].had_err && qos[r].qo.Hide.Bool && slices.Contains(qos[q].expr.refs, qos[r].q.RefID) {
+					qos[r].qo.Hide.Bool = false
+					hidden_refs = append(hidden_refs, qos[r].q.RefID)
+					changed = true
+				}
 			}
 		}
-
-	} else {
-		indiv = qos
 	}
 
-	for q := range indiv {
-		var this_q = indiv[q]
+	d.resolveFilterDefinitions(ctx, api_token, qos)
+
+	var to_combine []QueryOptions
+	var singles [][]QueryOptions
+	var variables []qos_return
+	var expressions []expressionQuery
+	var num_combined = 0
+	duplicates := newDuplicateQueries()
+	expanded := newExpandedQueries()
+	for q := range qos {
+		var this_q = qos[q]
 		if this_q.had_err {
 			response.Responses[this_q.q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", this_q.err.Error()))
 		} else if this_q.qo.Hide.Bool {
@@ -204,180 +232,316 @@ func (d *handler) QueryData(ctx context.Context, req *backend.QueryDataRequest)
 			response.Responses[this_q.q.RefID] = blank_response
 		} else if !this_q.is_valid {
 			var blank_response backend.DataResponse
-			blank_response.Error = fmt.Errorf("Invalid Query %q", this_q.q.RefID)
+			if this_q.err != nil {
+				blank_response.Error = this_q.err
+			} else if this_q.qo.FilterId != "" || !this_q.qo.FastMode {
+				blank_response.Error = fmt.Errorf("Invalid Query %q", this_q.q.RefID)
+			}
 			response.Responses[this_q.q.RefID] = blank_response
-
+		} else if this_q.expr != nil {
+			expressions = append(expressions, *this_q.expr)
+		} else if this_q.qo.Mode == "variables" {
+			if !duplicates.add(*this_q.qo) {
+				variables = append(variables, this_q)
+			}
 		} else {
-			var res backend.DataResponse
-			if this_q.qo.Mode == "variables" {
-				res = d.queryGroupings(ctx, api_token, req.PluginContext, this_q.q, *this_q.qo)
-			} else {
-				res = *d.queryMulti(ctx, api_token, req.PluginContext, []QueryOptions{*this_q.qo})[this_q.q.RefID]
+			subs := expandQuery(*this_q.qo)
+			if len(subs) > 1 {
+				expanded.add(*this_q.qo, subs)
+			}
+			var sent []QueryOptions
+			for _, sub := range subs {
+				if !duplicates.add(sub) {
+					sent = append(sent, sub)
+				}
 			}
-			response.Responses[this_q.q.RefID] = res
+			// fast mode is up to each query, a first query that failed to parse has no
+			// options to decide it for the others
+			if this_q.qo.FastMode {
+				// duplicates still count towards the combined queries, so series names
+				// don't depend on whether a query was sent
+				num_combined++
+				to_combine = append(to_combine, sent...)
+			} else if len(sent) > 0 {
+				singles = append(singles, sent)
+			}
+		}
+	}
+
+	batches := planBatches(to_combine, num_combined, d.config.MaxBatchSize)
+	for _, qos := range singles {
+		if len(qos) == 1 {
+			batches = append(batches, queryBatch{Queries: qos, NumQueries: 1, Reason: "fast mode off"})
+			continue
 		}
+		// the series of a query are still sent together
+		for _, batch := range planBatches(qos, 1, d.config.MaxBatchSize) {
+			batch.Reason = "fast mode off, series of a single query, " + batch.Reason
+			batches = append(batches, batch)
+		}
+	}
+
+	// batches and variable queries are independent, they run concurrently within the
+	// concurrency limit of the instance
+	parallel := d.newParallelResponses(ctx, response)
+	for i, batch := range batches {
+		parallel.start(func() map[string]*backend.DataResponse {
+			return d.runBatch(ctx, api_token, req.PluginContext, batch, i, len(batches))
+		})
+	}
+	for _, this_q := range variables {
+		parallel.run([]string{this_q.q.RefID}, func() map[string]*backend.DataResponse {
+			res := d.queryGroupings(ctx, api_token, req.PluginContext, this_q.q, *this_q.qo)
+			return map[string]*backend.DataResponse{this_q.q.RefID: &res}
+		})
+	}
+	parallel.wait()
+	duplicates.fanOut(response)
+	expanded.join(response, num_combined)
+	evaluateExpressions(expressions, response)
+	for _, id := range hidden_refs {
+		response.Responses[id] = backend.DataResponse{}
 	}
 
 	return response, nil
 }
 
-const url_base = "https://app.aggregations.io/api/v1/"
+// resolveFilterDefinitions fills in missing filter names from the cached filter
+// definitions and rejects queries for aggregations or calculations the filter doesn't
+// have. The definitions are looked up once for all of qos, and refreshed at most once
+// when a query needs a filter or an aggregation they don't have. When the definitions
+// can't be loaded in time the queries are sent as they are and the API reports what is
+// wrong with them.
+func (d *handler) resolveFilterDefinitions(ctx context.Context, token string, qos []qos_return) {
+	if !slices.ContainsFunc(qos, needsFilterDefinition) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, filterDefinitionLookupTimeout)
+	defer cancel()
+	defs, err := d.filterDefinitions(ctx, token)
+	if err != nil {
+		return
+	}
+	refreshed := false
+	for i := range qos {
+		q := &qos[i]
+		if !needsFilterDefinition(*q) {
+			continue
+		}
+		fd := findFilterDefinition(defs, q.qo.FilterId)
+		subs := expandQuery(*q.qo)
+		if (fd == nil || fd.missingAggregation(subs) && q.qo.Mode != "variables") && !refreshed && d.filterDefs.age(token) >= minFilterDefinitionRefresh {
+			// the filter or aggregation may have been added after the definitions were cached
+			refreshed = true
+			if defs, err = d.refreshFilterDefinitions(ctx, token); err != nil {
+				return
+			}
+			fd = findFilterDefinition(defs, q.qo.FilterId)
+		}
+		if fd == nil {
+			continue
+		}
 
-//const url_base = "http://host.docker.internal:5060/api/v1/"
+		if q.qo.FilterDefinitionName == "" {
+			q.qo.FilterDefinitionName = fd.Name
+		}
+		if fd.Groupings != nil {
+			q.qo.GroupingOrder = *fd.Groupings
+		}
+		if fd.GroupingItems != nil {
+			q.qo.GroupingAliases = make(map[string]string)
+			for _, item := range *fd.GroupingItems {
+				if item.Alias != "" {
+					q.qo.GroupingAliases[item.Grouping] = item.Alias
+				}
+			}
+		}
+		if q.qo.Mode == "variables" {
+			continue
+		}
+		q.qo.AggregationNames = make(map[int]string)
+		for _, sub := range subs {
+			agg := fd.Aggregation(sub.AggregationId)
+			if agg == nil {
+				q.is_valid = false
+				q.err = fmt.Errorf("Invalid Query %q: aggregation %d not found in filter %q", q.q.RefID, sub.AggregationId, fd.Name)
+				break
+			} else if len(agg.Calculations) > 0 && !slices.Contains(agg.Calculations, sub.Calculation) {
+				q.is_valid = false
+				q.err = fmt.Errorf("Invalid Query %q: calculation %s not available for aggregation %q", q.q.RefID, sub.Calculation, agg.Name)
+				break
+			}
+			q.qo.AggregationNames[sub.AggregationId] = agg.Name
+		}
+		q.qo.AggregationName = q.qo.AggregationNames[q.qo.AggregationId]
+	}
+}
 
-func (d *handler) queryMulti(_ context.Context, password string, Ctx backend.PluginContext, qos []QueryOptions) map[string]*backend.DataResponse {
+// needsFilterDefinition reports whether q is sent upstream and needs its definition.
+func needsFilterDefinition(q qos_return) bool {
+	return !q.had_err && q.is_valid && !q.qo.Hide.Bool && q.expr == nil
+}
+
+// queryMulti runs qos in a single metrics/results call, serving what it can from the
+// caches. num_queries is the number of queries combined for the panel, series are
+// prefixed with the query name when there is more than one. The returned error is set
+// when the upstream call failed, the responses of the fetched queries then carry it.
+func (d *handler) queryMulti(ctx context.Context, password string, Ctx backend.PluginContext, qos []QueryOptions, num_queries int) (map[string]*backend.DataResponse, error) {
 
 	var response = make(map[string]*backend.DataResponse)
+	var results = make(map[string]*queryResult)
+	var cache_status = make(map[string]string)
 
+	var to_fetch []QueryOptions
 	var qos_map = make(map[string]QueryOptions)
-
+	var partial = make(map[string]*queryResult)
 	for q := range qos {
 		var this_q = qos[q]
 		var this_response backend.DataResponse
 		response[this_q.QueryId] = &this_response
 		qos_map[this_q.QueryId] = this_q
+		if res, ok := d.results.get(resultCacheKey(password, this_q)); ok {
+			results[this_q.QueryId] = res
+			cache_status[this_q.QueryId] = cacheHit
+		} else if base, tail, ok := d.incrementalQuery(password, this_q); ok {
+			partial[this_q.QueryId] = base
+			to_fetch = append(to_fetch, tail)
+		} else {
+			to_fetch = append(to_fetch, this_q)
+		}
+	}
+
+	var fetch_err error
+	if len(to_fetch) > 0 {
+		fetched, coalesced, err := d.fetchResults(ctx, password, to_fetch)
+		if err != nil {
+			fetch_err = err
+			SetError(err, to_fetch, response)
+		} else {
+			now := time.Now()
+			for _, fetched_q := range to_fetch {
+				var this_q = qos_map[fetched_q.QueryId]
+				res := fetched[this_q.QueryId]
+				cache_status[this_q.QueryId] = cacheMiss
+				if coalesced {
+					cache_status[this_q.QueryId] = cacheCoalesced
+				}
+				if base, ok := partial[this_q.QueryId]; ok {
+					from, _ := time.Parse(time.RFC3339, this_q.StartTime)
+					res = mergeTail(base, res, from, res.From, this_q.GroupingOrder)
+					cache_status[this_q.QueryId] = cachePartial
+				}
+				results[this_q.QueryId] = res
+				if ttl := d.config.ResultTTL(this_q, now); ttl > 0 {
+					d.results.set(resultCacheKey(password, this_q), res, ttl)
+				}
+				if ttl := d.config.IncrementalTTL(); ttl > 0 {
+					d.series.set(seriesCacheKey(password, this_q), res, ttl)
+				}
+			}
+		}
+	}
+
+	for q := range qos {
+		var this_q = qos[q]
+		res, ok := results[this_q.QueryId]
+		if !ok {
+			continue
+		}
+		ProcessFramesFromMR(res, response[this_q.QueryId], this_q, num_queries)
+		setCustomMeta(response[this_q.QueryId].Frames, func(m *frameCustomMeta) {
+			m.Cache = cache_status[this_q.QueryId]
+		})
 	}
+	return response, fetch_err
+}
 
-	PrintJson(qos_map)
-	client := d.httpClient
+// queryResult holds the points the API returned for a single query, sorted by time.
+// Results are shared through the result cache and must not be modified once built.
+type queryResult struct {
+	// HasData is set once a value was returned for the query, otherwise no frame is built.
+	HasData bool
+	// Groupings are the grouping keys of the query, in the order of the frame columns.
+	Groupings []string
+	// Times and Values hold a point each, GroupingValues[k] has the value of
+	// Groupings[k] for every point.
+	Times          []time.Time
+	Values         []float64
+	GroupingValues [][]string
+	// From and To are the time range the points were requested for.
+	From time.Time
+	To   time.Time
+}
 
-	payloadbytes, err := json.Marshal(qos)
-	if err != nil {
-		SetError(err, qos, response)
-		return response
+// fetchResults posts qos to metrics/results in a single call and splits the
+// returned points by query. Identical calls in flight for other requests are shared,
+// coalesced reports whether that happened.
+func (d *handler) fetchResults(ctx context.Context, password string, qos []QueryOptions) (results map[string]*queryResult, coalesced bool, err error) {
+	payload := make([]upstreamQuery, len(qos))
+	for i := range qos {
+		payload[i] = qos[i].upstream()
 	}
-	request, err := http.NewRequest("POST", url_base+"metrics/results?multi=true", bytes.NewBuffer(payloadbytes))
+	payloadbytes, err := json.Marshal(payload)
 	if err != nil {
-		SetError(err, qos, response)
-		return response
+		return nil, false, err
 	}
-	request.Header.Set("x-api-token", password)
-	request.Header.Set("Content-Type", "application/json")
+	return d.inflight.do(ctx, coalesceKey(password, payloadbytes), func(ctx context.Context) (map[string]*queryResult, error) {
+		return d.postResults(ctx, password, payloadbytes, qos)
+	})
+}
 
-	http_response, err := client.Do(request)
+func (d *handler) postResults(ctx context.Context, password string, payloadbytes []byte, qos []QueryOptions) (map[string]*queryResult, error) {
+	http_response, err := d.doRequest(ctx, "POST", "metrics/results?multi=true", password, payloadbytes)
 	if err != nil {
-		SetError(err, qos, response)
-		return response
+		return nil, err
 	}
 	defer http_response.Body.Close()
 
 	if http_response.StatusCode != 200 {
 		body, err := io.ReadAll(http_response.Body)
 		if err != nil {
-			SetError(err, qos, response)
-			return response
+			return nil, err
 		}
 		//backend.Logger.Warn(http_response.Status)
-		SetError(fmt.Errorf("Error fetching results %q / %q", http_response.Status, string(body)), qos, response)
-		return response
+		return nil, &apiError{Path: "metrics/results", StatusCode: http_response.StatusCode, Status: http_response.Status, Body: body}
 	}
 
-	set_frames := make(map[string]bool)
-	frames := make(map[string]*data.Frame)
-	names := make(map[string][]string)
-	finals := make(map[string][]MetricResultVal)
-
-	iSlice := func(is ...interface{}) []interface{} {
-		s := make([]interface{}, len(is))
-		copy(s, is)
-		return s
-	}
-	for q := range qos {
-		var this_q = qos[q]
-		set_frames[this_q.QueryId] = false
-		frames[this_q.QueryId] = data.NewFrameOfFieldTypes("response", 0, data.FieldTypeTime, data.FieldTypeFloat64)
-		names[this_q.QueryId] = make([]string, 2)
-		var this_finals []MetricResultVal
-		finals[this_q.QueryId] = this_finals
-
-	}
-
-	body, err := io.ReadAll(http_response.Body)
-	if err != nil {
-		SetError(err, qos, response)
-		return response
-	}
-
-	var metrics []MetricResult
-	if err := json.Unmarshal(body, &metrics); err != nil {
-		SetError(err, qos, response)
-		return response
-	}
+	return decodeMetricResults(http_response.Body, qos)
+}
 
-	current_dt_start := time.Unix(0, 0)
-	current_groupings := map[string]string{}
+// frameCustomMeta is reported in the custom meta of the frames we return and shows
+// up in the query inspector.
+type frameCustomMeta struct {
+	Cache            string `json:"cache,omitempty"`
+	DeduplicatedFrom string `json:"deduplicatedFrom,omitempty"`
+}
 
-	var single_q = len(qos) == 1
-	for _, mr := range metrics {
-		if !mr.IsSeperator.Valid && single_q {
-			mr.QueryId.SetValid(qos[0].QueryId)
+// updateMeta updates the meta of every frame in frames. Frames may share their meta,
+// so it is copied before the update.
+func updateMeta(frames data.Frames, update func(meta *data.FrameMeta)) {
+	for _, f := range frames {
+		var meta data.FrameMeta
+		if f.Meta != nil {
+			meta = *f.Meta
 		}
-		if mr.QueryId.Valid && !set_frames[mr.QueryId.String] && current_dt_start != time.Unix(0, 0) {
-			set_frames[mr.QueryId.String] = true
-			PrintJson(set_frames)
-			var this_names = make([]string, 2+len(current_groupings))
-
-			data_types := make([]data.FieldType, len(this_names))
-			this_names[0] = "time"
-			data_types[0] = data.FieldTypeTime
-			currk := 1
-			for k := range current_groupings {
-				data_types[currk] = data.FieldTypeString
-				this_names[currk] = k
-				currk++
-			}
-			this_names[currk] = qos_map[mr.QueryId.String].FilterDefinitionName
+		update(&meta)
+		f.Meta = &meta
+	}
+}
 
-			if qos_map[mr.QueryId.String].Alias != "" {
-				this_names[currk] = qos_map[mr.QueryId.String].Alias
-			}
-			PrintJson(this_names)
-			names[mr.QueryId.String] = this_names
-			data_types[currk] = data.FieldTypeFloat64
-			this_frame := data.NewFrameOfFieldTypes("Long", 0, data_types...).SetMeta(&data.FrameMeta{
-				Type:        data.FrameTypeTimeSeriesLong,
-				TypeVersion: data.FrameTypeVersion{0, 0},
-			})
-
-			this_frame.SetFieldNames(this_names...)
-			this_frame.Meta = &data.FrameMeta{}
-			frames[mr.QueryId.String] = this_frame
-		}
-		if mr.IsSeperator.Bool {
-			current_dt_start = mr.Dt.Time
-			current_groupings = *mr.Groupings
-			continue
+// setCustomMeta updates the custom meta of every frame in frames.
+func setCustomMeta(frames data.Frames, update func(m *frameCustomMeta)) {
+	updateMeta(frames, func(meta *data.FrameMeta) {
+		m, _ := meta.Custom.(*frameCustomMeta)
+		if m == nil {
+			m = &frameCustomMeta{}
 		} else {
-			mrv := MetricResultVal{Dt: current_dt_start.Add(time.Second * time.Duration(mr.DtSecLater)), Val: mr.Val, Groupings: current_groupings, QueryId: mr.QueryId.String}
-			finals[mr.QueryId.String] = append(finals[mr.QueryId.String], mrv)
+			copied := *m
+			m = &copied
 		}
-
-	}
-	//backend.Logger.Info("SORTING?")
-	for q := range qos {
-		var this_q = qos[q]
-		sort.Slice(finals[this_q.QueryId][:], func(i, j int) bool {
-			return finals[this_q.QueryId][i].Dt.Before(finals[this_q.QueryId][j].Dt)
-		})
-		for _, mrv := range finals[this_q.QueryId] {
-			rr := iSlice(mrv.Dt)
-			for k := range names[this_q.QueryId] {
-				if k > 0 && k < len(names[this_q.QueryId])-1 {
-					val, ok := mrv.Groupings[names[this_q.QueryId][k]]
-					if ok {
-						rr = append(rr, val)
-					} else {
-						rr = append(rr, "")
-					}
-				}
-			}
-			rr = append(rr, mrv.Val)
-			//PrintJson(rr)
-			frames[this_q.QueryId].AppendRow(rr...)
-		}
-		ProcessFramesFromMR(set_frames[this_q.QueryId], response[this_q.QueryId], qos_map[this_q.QueryId], names[this_q.QueryId], frames[this_q.QueryId], len(qos))
-	}
-	return response
+		update(m)
+		meta.Custom = m
+	})
 }
 
 func SetError(err error, qos []QueryOptions, response map[string]*backend.DataResponse) {
@@ -388,61 +552,102 @@ func SetError(err error, qos []QueryOptions, response map[string]*backend.DataRe
 	}
 }
 
-func ProcessFramesFromMR(set_frames bool, response *backend.DataResponse, qo QueryOptions, names []string, frame2 *data.Frame, num_queries int) bool {
-	if set_frames {
-		if !qo.LongResult.Bool && len(names) > 2 {
-			w, err := data.LongToWide(frame2, &data.FillMissing{Mode: data.FillModeNull})
+func ProcessFramesFromMR(res *queryResult, response *backend.DataResponse, qo QueryOptions, num_queries int) bool {
+	if res.HasData {
+		var legend legendTemplate
+		if qo.LegendFormat != "" {
+			legend = parseLegend(qo.LegendFormat)
+		}
+		if qo.Instant && qo.Format != formatNumeric {
+			frame, err := buildNumericTable(qo, res)
 			if err != nil {
 				response.Error = err
-				return false
+				return true
 			}
-			for f := range w.Fields {
-				var dn strings.Builder
-
-				if num_queries > 1 {
-					dn.WriteString(names[len(names)-1])
-					dn.WriteString(": ")
+			value := frame.Fields[len(frame.Fields)-1]
+			if dn := displayName(qo, legend, qo.SeriesLabels, num_queries); dn != "" {
+				value.Config = &data.FieldConfig{DisplayNameFromDS: dn}
+			}
+			response.Frames = append(response.Frames, frame)
+		} else if qo.Format == formatMulti || qo.Format == formatNumeric {
+			var frames data.Frames
+			if qo.Format == formatNumeric {
+				frames = buildNumericFrames(qo, res)
+			} else {
+				frames = buildMultiFrames(qo, res)
+			}
+			for _, frame := range frames {
+				value := frame.Fields[len(frame.Fields)-1]
+				if dn := displayName(qo, legend, value.Labels, num_queries); dn != "" {
+					value.Config = &data.FieldConfig{DisplayNameFromDS: dn}
 				}
-				var lbls = w.Fields[f].Labels
-				if lbls != nil {
-
-					keys := make([]string, len(lbls))
-					i := 0
-					for k := range lbls {
-						keys[i] = k
-						i++
-					}
-					sort.Strings(keys)
-					i = 0
-					for _, k := range keys {
-						if qo.IncludeGroupingLabels {
-							dn.WriteString(k)
-							dn.WriteString("=")
-						}
-						if lbls[k] == "" {
-							dn.WriteString("\"\"")
-						} else {
-							dn.WriteString(lbls[k])
-						}
-						if i != len(keys)-1 {
-							dn.WriteString(", ")
-						}
-						i++
-					}
-
-					w.Fields[f].Config = &data.FieldConfig{DisplayNameFromDS: dn.String()}
+			}
+			response.Frames = append(response.Frames, frames...)
+		} else if !qo.LongResult.Bool && len(res.Groupings) > 0 {
+			w := buildWideFrame(qo, res)
+			for f := range w.Fields {
+				if w.Fields[f].Labels != nil {
+					w.Fields[f].Config = &data.FieldConfig{DisplayNameFromDS: displayName(qo, legend, w.Fields[f].Labels, num_queries)}
 				}
-
 			}
 			response.Frames = append(response.Frames, w)
 		} else {
-			response.Frames = append(response.Frames, frame2)
+			frame := buildLongFrame(qo, res)
+			if len(res.Groupings) == 0 && (legend != nil || qo.SeriesLabels != nil) {
+				// a single series, the template and the sub query labels can still name it
+				value := frame.Fields[len(frame.Fields)-1]
+				if name := displayName(qo, legend, qo.SeriesLabels, num_queries); name != "" {
+					value.Config = &data.FieldConfig{DisplayNameFromDS: name}
+				}
+			}
+			response.Frames = append(response.Frames, frame)
 		}
 
 	}
 	return true
 }
 
+// displayName names a series of qo after its labels, or after the legend template
+// when the query has one.
+func displayName(qo QueryOptions, legend legendTemplate, lbls data.Labels, num_queries int) string {
+	if name := legend.render(qo, lbls); name != "" {
+		return name
+	}
+	if len(lbls) == 0 {
+		return ""
+	}
+	var dn strings.Builder
+
+	if num_queries > 1 {
+		dn.WriteString(valueName(qo))
+		dn.WriteString(": ")
+	}
+	keys := make([]string, len(lbls))
+	i := 0
+	for k := range lbls {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+	i = 0
+	for _, k := range keys {
+		if qo.IncludeGroupingLabels {
+			dn.WriteString(k)
+			dn.WriteString("=")
+		}
+		if lbls[k] == "" {
+			dn.WriteString("\"\"")
+		} else {
+			dn.WriteString(lbls[k])
+		}
+		if i != len(keys)-1 {
+			dn.WriteString(", ")
+		}
+		i++
+	}
+	return dn.String()
+}
+
 func parseResponseData(responseData []byte) ([]MetricResult, error) {
 	var results []MetricResult
 	err := json.Unmarshal(responseData, &results)
@@ -456,27 +661,18 @@ func parseResponseData(responseData []byte) ([]MetricResult, error) {
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (d *handler) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+func (d *handler) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	pluginCtx := req.PluginContext
-	api_token := pluginCtx.DataSourceInstanceSettings.DecryptedSecureJSONData["apiKey"]
-	client := d.httpClient
+	api_token := apiToken(pluginCtx)
 
-	request, err := http.NewRequest("GET", url_base+"organization/ping", nil)
-	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "Error",
-		}, nil
-	}
-	request.Header.Set("x-api-token", api_token)
-	request.Header.Set("Content-Type", "application/json")
-	http_response, err := client.Do(request)
+	http_response, err := d.doRequest(ctx, "GET", "organization/ping", api_token, nil)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: "Error",
 		}, nil
 	}
+	defer http_response.Body.Close()
 	if http_response.StatusCode == 401 {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
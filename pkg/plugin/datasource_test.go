@@ -1,10 +1,24 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 func TestQueryData(t *testing.T) {
@@ -26,3 +40,672 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+const testFilterDefinitions = `[{"id":"f","name":"Logins","groupings":["os","country"],"groupingItems":[{"grouping":"os","alias":"OS"}],` +
+	`"aggregations":[{"id":1,"name":"All","calculations":["COUNT","AVG","PERCENTILES"]},{"id":2,"name":"Failed","calculations":["COUNT"]}]}]`
+
+// slowServer answers only once the client went away, or after a long delay.
+// cancelled receives a value for every request the client abandoned.
+func slowServer(cancelled chan<- struct{}) *httptest.Server {
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices a closed connection once the body was consumed
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+			w.Write([]byte("[]"))
+		}
+	})
+	return srv
+}
+
+func TestQueryDataCancellation(t *testing.T) {
+	for _, mode := range []string{"", "variables"} {
+		cancelled := make(chan struct{}, 1)
+		srv := slowServer(cancelled)
+		ds := newTestHandler(t, srv.URL)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","groupingName":"os","mode":"` + mode + `"}`)},
+			},
+		})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("mode %q: query kept running for %v after the deadline", mode, elapsed)
+		}
+		if resp.Responses["A"].Error == nil {
+			t.Errorf("mode %q: expected the deadline to surface as an error", mode)
+		}
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("mode %q: upstream request was not cancelled", mode)
+		}
+		srv.Close()
+	}
+}
+
+func TestFilterDefinitionCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(testFilterDefinitions))
+	}))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ds.filterDefinitions(context.Background(), "token"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	defs, err := ds.filterDefinitions(context.Background(), "token")
+	if fd := findFilterDefinition(defs, "f"); err != nil || fd == nil || fd.Name != "Logins" {
+		t.Fatalf("got %v, %v", fd, err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single upstream call, got %d", calls.Load())
+	}
+
+	ds.filterDefs.invalidate("token")
+	if _, err := ds.filterDefinitions(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected invalidation to refetch, got %d calls", calls.Load())
+	}
+}
+
+func TestQueryDataLooksUpDefinitionsOnce(t *testing.T) {
+	srv, calls := apiServer(serveMetrics("[]"))
+	defer srv.Close()
+	ds := newTestHandlerWithSettings(t, `{"baseUrl":"`+srv.URL+`","filterDefinitionCacheSeconds":-1}`)
+
+	var queries []backend.DataQuery
+	for _, refID := range []string{"A", "B", "C", "D", "E"} {
+		queries = append(queries, backend.DataQuery{RefID: refID, JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","alias":"` + refID + `"}`)})
+	}
+	if _, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries}); err != nil {
+		t.Fatal(err)
+	}
+	if n := callCount(calls, "/api/v1/filter-definitions"); n != 1 {
+		t.Errorf("expected a single definitions lookup for the request, got %d", n)
+	}
+}
+
+func TestQueryDataValidatesAggregation(t *testing.T) {
+	srv, calls := apiServer(serveMetrics("[]"))
+	defer srv.Close()
+
+	resp, err := newTestHandler(t, srv.URL).QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":3,"calculation":"COUNT"}`)},
+			{RefID: "B", JSON: []byte(`{"filterId":"f","aggregationId":2,"calculation":"AVG"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, refID := range []string{"A", "B"} {
+		if resp.Responses[refID].Error == nil {
+			t.Errorf("%s: expected a validation error", refID)
+		}
+	}
+	if n := callCount(calls, "/api/v1/metrics/results"); n != 0 {
+		t.Errorf("expected invalid queries not to be sent, got %d calls", n)
+	}
+}
+
+// testMetrics is a metrics/results response for query A, grouped by os and country.
+const testMetrics = `[
+{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":"ios","country":"US"},"queryId":"A"},
+{"dtSecLater":60,"val":2,"queryId":"A"},
+{"dtSecLater":0,"val":1,"queryId":"A"},
+{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":"android","country":"US"},"queryId":"A"},
+{"dtSecLater":0,"val":3,"queryId":"A"}
+]`
+
+// apiServer serves testFilterDefinitions and hands every other call, e.g.
+// metrics/results, to results. It counts the calls made to each path.
+func apiServer(results http.HandlerFunc) (*httptest.Server, *sync.Map) {
+	calls := &sync.Map{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := calls.LoadOrStore(r.URL.Path, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		if strings.HasSuffix(r.URL.Path, "/filter-definitions") {
+			w.Write([]byte(testFilterDefinitions))
+			return
+		}
+		results(w, r)
+	}))
+	return srv, calls
+}
+
+// serveMetrics answers every call with the same metrics/results response.
+func serveMetrics(metrics string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(metrics))
+	}
+}
+
+func callCount(calls *sync.Map, path string) int32 {
+	n, ok := calls.Load(path)
+	if !ok {
+		return 0
+	}
+	return n.(*atomic.Int32).Load()
+}
+
+func TestQueryDataResultCache(t *testing.T) {
+	srv, calls := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			Interval:  time.Minute,
+			TimeRange: backend.TimeRange{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":true}`),
+		}},
+	}
+	for i, want := range []string{cacheMiss, cacheHit} {
+		resp, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		if len(res.Frames) != 1 || res.Frames[0].Rows() != 3 {
+			t.Fatalf("call %d: unexpected frames %v", i, res.Frames)
+		}
+		if m := res.Frames[0].Meta.Custom.(*frameCustomMeta); m.Cache != want {
+			t.Errorf("call %d: got cache %q, want %q", i, m.Cache, want)
+		}
+	}
+	if n := callCount(calls, "/api/v1/metrics/results"); n != 1 {
+		t.Fatalf("expected a single upstream call, got %d", n)
+	}
+}
+
+func TestResultTTL(t *testing.T) {
+	s, _ := LoadSettings(backend.DataSourceInstanceSettings{})
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	qo := QueryOptions{Interval: time.Minute, EndTime: "2024-01-01T11:00:00Z"}
+	if ttl := s.ResultTTL(qo, now); ttl != 5*time.Minute {
+		t.Errorf("complete: got %v", ttl)
+	}
+	qo.EndTime = "2024-01-01T12:00:30Z"
+	if ttl := s.ResultTTL(qo, now); ttl != 30*time.Second {
+		t.Errorf("until the interval completes: got %v", ttl)
+	}
+	qo.IncludeIncompleteIntervals = true
+	if ttl := s.ResultTTL(qo, now); ttl != 10*time.Second {
+		t.Errorf("incomplete: got %v", ttl)
+	}
+}
+
+func TestQueryDataIncremental(t *testing.T) {
+	responses := []string{testMetrics, `[
+{"isSeperator":true,"dt":"2024-01-01T00:01:00Z","groupings":{"os":"ios","country":"US"},"queryId":"A"},
+{"dtSecLater":0,"val":5,"queryId":"A"},
+{"dtSecLater":60,"val":6,"queryId":"A"}
+]`}
+	var requested []QueryOptions
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		requested = append(requested, qos...)
+		w.Write([]byte(responses[len(requested)-1]))
+	})
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	query := func(from, to time.Time) backend.DataResponse {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				Interval:  time.Minute,
+				TimeRange: backend.TimeRange{From: from, To: to},
+				JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":true}`),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query(start, start.Add(90*time.Second))
+	res := query(start.Add(30*time.Second), start.Add(150*time.Second))
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	if len(requested) != 2 || requested[1].StartTime != "2024-01-01T00:01:00Z" {
+		t.Fatalf("expected the second call to fetch the tail only, got %+v", requested)
+	}
+	frame := res.Frames[0]
+	if m := frame.Meta.Custom.(*frameCustomMeta); m.Cache != cachePartial {
+		t.Errorf("got cache %q", m.Cache)
+	}
+	if frame.Rows() != 2 {
+		t.Fatalf("expected the points before the range to be dropped, got %d rows", frame.Rows())
+	}
+	val := frame.Fields[len(frame.Fields)-1]
+	if val.At(0).(float64) != 5 || val.At(1).(float64) != 6 {
+		t.Errorf("expected the tail to replace the kept points, got %v, %v", val.At(0), val.At(1))
+	}
+}
+
+func TestQueryDataIncrementalGroupingOrder(t *testing.T) {
+	// the kept series only have the country, the os appears with the tail
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		if qos[0].StartTime == "2024-01-01T00:00:00Z" {
+			w.Write([]byte(`[{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"country":"US"},"queryId":"A"},{"dtSecLater":0,"val":1,"queryId":"A"},{"dtSecLater":60,"val":2,"queryId":"A"}]`))
+			return
+		}
+		w.Write([]byte(`[{"isSeperator":true,"dt":"2024-01-01T00:01:00Z","groupings":{"os":"ios","country":"US"},"queryId":"A"},{"dtSecLater":0,"val":5,"queryId":"A"},{"dtSecLater":60,"val":6,"queryId":"A"}]`))
+	})
+	defer srv.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(ds *handler, from, to time.Time) *data.Frame {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				Interval:  time.Minute,
+				TimeRange: backend.TimeRange{From: from, To: to},
+				JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":true}`),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := resp.Responses["A"]; res.Error != nil || len(res.Frames) != 1 {
+			t.Fatalf("unexpected response %v", res)
+		}
+		return resp.Responses["A"].Frames[0]
+	}
+	cached := newTestHandler(t, srv.URL)
+	query(cached, start, start.Add(90*time.Second))
+	merged := query(cached, start.Add(30*time.Second), start.Add(150*time.Second))
+	if m := merged.Meta.Custom.(*frameCustomMeta); m.Cache != cachePartial {
+		t.Fatalf("got cache %q", m.Cache)
+	}
+	cold := query(newTestHandler(t, srv.URL), start.Add(30*time.Second), start.Add(150*time.Second))
+	if len(merged.Fields) != len(cold.Fields) || merged.Rows() != cold.Rows() {
+		t.Fatalf("expected the merged series to match a cold fetch, got %d fields and %d rows, want %d and %d", len(merged.Fields), merged.Rows(), len(cold.Fields), cold.Rows())
+	}
+	for k, f := range merged.Fields {
+		if f.Name != cold.Fields[k].Name {
+			t.Errorf("column %d: got %q, want %q", k, f.Name, cold.Fields[k].Name)
+		}
+		for i := 0; i < f.Len(); i++ {
+			if got, want := f.At(i), cold.Fields[k].At(i); got != want {
+				t.Errorf("%s[%d]: got %v, want %v", f.Name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestQueryDataConcurrencyLimit(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`[{"value":"ios"}]`))
+	})
+	defer srv.Close()
+	ds := newTestHandlerWithSettings(t, `{"baseUrl":"`+srv.URL+`","maxConcurrentQueries":2}`)
+
+	var queries []backend.DataQuery
+	for _, refID := range []string{"A", "B", "C", "D", "E", "F"} {
+		queries = append(queries, backend.DataQuery{RefID: refID, JSON: []byte(`{"filterId":"f","mode":"variables","groupingName":"os` + refID + `"}`)})
+	}
+	start := time.Now()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if res := resp.Responses[q.RefID]; res.Error != nil || len(res.Frames) != 1 {
+			t.Errorf("%s: unexpected response %v", q.RefID, res.Error)
+		}
+	}
+	if m := maxRunning.Load(); m != 2 {
+		t.Errorf("expected 2 queries in flight at most, got %d", m)
+	}
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("expected the queries to run concurrently, took %v", elapsed)
+	}
+}
+
+func TestQueryDataDeduplicates(t *testing.T) {
+	srv, calls := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var queries []backend.DataQuery
+	for _, refID := range []string{"A", "B", "C"} {
+		queries = append(queries, backend.DataQuery{
+			RefID:     refID,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":true}`),
+		})
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := callCount(calls, "/api/v1/metrics/results"); n != 1 {
+		t.Fatalf("expected a single upstream call, got %d", n)
+	}
+	for _, refID := range []string{"B", "C"} {
+		res := resp.Responses[refID]
+		if res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Rows() != 3 {
+			t.Fatalf("%s: expected the frames of A, got %v", refID, res)
+		}
+		if m := res.Frames[0].Meta.Custom.(*frameCustomMeta); m.DeduplicatedFrom != "A" {
+			t.Errorf("%s: got deduplicatedFrom %q", refID, m.DeduplicatedFrom)
+		}
+		if res.Frames[0].RefID != refID {
+			t.Errorf("%s: got refID %q", refID, res.Frames[0].RefID)
+		}
+	}
+}
+
+func TestQueryDataCoalescesConcurrentRequests(t *testing.T) {
+	var calls atomic.Int32
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(testMetrics))
+	})
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+	// warm the filter definitions, so both requests reach metrics/results together
+	ds.filterDefinitions(context.Background(), "")
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	req := &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID:     "A",
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":true}`),
+	}}}
+
+	statuses := make([]string, 2)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 20 * time.Millisecond)
+			resp, err := ds.QueryData(context.Background(), req)
+			if err != nil || resp.Responses["A"].Error != nil || len(resp.Responses["A"].Frames) != 1 {
+				t.Errorf("request %d: unexpected response %v %v", i, err, resp.Responses["A"])
+				return
+			}
+			statuses[i] = resp.Responses["A"].Frames[0].Meta.Custom.(*frameCustomMeta).Cache
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected a single upstream call, got %d", n)
+	}
+	if statuses[0] != cacheMiss || statuses[1] != cacheCoalesced {
+		t.Errorf("got cache statuses %v", statuses)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares got with testdata/name, rewriting the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s doesn't match:\n got %s\nwant %s", name, got, want)
+	}
+}
+
+func TestQueryDataGroupingOrder(t *testing.T) {
+	srv, _ := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, mode := range []string{"long", "wide"} {
+		query := backend.DataQuery{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","longResult":` + strconv.FormatBool(mode == "long") + `}`),
+		}
+		// grouping keys come from a map, a fresh handler per run doesn't reuse a decoded result
+		for i := 0; i < 20; i++ {
+			ds := newTestHandler(t, srv.URL)
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{query}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := resp.Responses["A"]
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			got, err := json.MarshalIndent(res.Frames, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "grouping_order_"+mode+".golden.json", got)
+			if t.Failed() {
+				return
+			}
+		}
+	}
+}
+
+func TestQueryDataGroupingAliases(t *testing.T) {
+	srv, _ := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var queries []backend.DataQuery
+	for refID, options := range map[string]string{"A": `"longResult":true`, "B": `"includeGroupingLabels":true`} {
+		queries = append(queries, backend.DataQuery{
+			RefID:     refID,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","useGroupingAliases":true,` + options + `}`),
+		})
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := resp.Responses["A"].Frames[0]
+	if names := []string{long.Fields[1].Name, long.Fields[2].Name}; names[0] != "OS" || names[1] != "country" {
+		t.Errorf("long: got columns %v", names)
+	}
+	wide := resp.Responses["B"].Frames[0].Fields[1]
+	if wide.Labels["OS"] != "android" || wide.Labels["country"] != "US" {
+		t.Errorf("wide: got labels %v", wide.Labels)
+	}
+	if dn := wide.Config.DisplayNameFromDS; dn != "OS=android, country=US" {
+		t.Errorf("wide: got display name %q", dn)
+	}
+}
+
+func TestQueryDataFormats(t *testing.T) {
+	srv, _ := apiServer(serveMetrics(testMetrics))
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for format, want := range map[string]data.FrameType{"multi": data.FrameTypeTimeSeriesMulti, "numeric": data.FrameTypeNumericMulti} {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","format":"` + format + `","reducer":"sum"}`),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil || len(res.Frames) != 2 {
+			t.Fatalf("%s: expected a frame per series, got %v", format, res)
+		}
+		for _, f := range res.Frames {
+			if f.Meta.Type != want || f.Meta.ExecutedQueryString == "" {
+				t.Errorf("%s: got meta %+v", format, f.Meta)
+			}
+		}
+		value := res.Frames[1].Fields[len(res.Frames[1].Fields)-1]
+		if value.Labels["os"] != "ios" || value.Labels["country"] != "US" {
+			t.Errorf("%s: got labels %v", format, value.Labels)
+		}
+		if format == "numeric" && value.At(0).(float64) != 3 {
+			t.Errorf("numeric: expected the sum of ios, got %v", value.At(0))
+		}
+	}
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{
+		{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","format":"table"}`)},
+		{RefID: "B", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","reducer":"median"}`)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, refID := range []string{"A", "B"} {
+		if resp.Responses[refID].Error == nil {
+			t.Errorf("%s: expected a validation error", refID)
+		}
+	}
+}
+
+func TestQueryDataInstant(t *testing.T) {
+	var requested []QueryOptions
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		requested = append(requested, qos...)
+		w.Write([]byte(testMetrics))
+	})
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(json string) backend.DataResponse {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID:     "A",
+			Interval:  time.Minute,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(json),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	res := query(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","instant":true}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(requested) != 1 || requested[0].RecalculatedInterval == nil || requested[0].RecalculatedInterval.Frequency != 3600 {
+		t.Fatalf("expected the API to aggregate the whole range, got %+v", requested)
+	}
+	if len(res.Frames) != 1 || res.Frames[0].Meta.Type != data.FrameTypeNumericLong {
+		t.Fatalf("expected a numeric table, got %v", res.Frames)
+	}
+	checkInstant := func(frame *data.Frame, android float64, ios float64) {
+		t.Helper()
+		if len(frame.Fields) != 3 || frame.Fields[0].Name != "os" || frame.Fields[1].Name != "country" || frame.Rows() != 2 {
+			t.Fatalf("expected a row per grouping, got %s", frameTable(frame))
+		}
+		value := frame.Fields[2]
+		if frame.Fields[0].At(0) != "android" || value.At(0).(float64) != android || value.At(1).(float64) != ios {
+			t.Errorf("got %s", frameTable(frame))
+		}
+	}
+	// ios spans two intervals, counts add up
+	checkInstant(res.Frames[0], 3, 3)
+
+	res = query(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","instant":true,"reducer":"min"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if requested[1].RecalculatedInterval != nil {
+		t.Errorf("expected the intervals to be reduced locally, got %+v", requested[1].RecalculatedInterval)
+	}
+	checkInstant(res.Frames[0], 3, 1)
+
+	res = query(`{"filterId":"f","aggregationId":1,"calculation":"AVG","instant":true}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "spans 2 intervals") {
+		t.Errorf("expected averages over two intervals to be refused without a reducer, got %v", res.Error)
+	}
+	res = query(`{"filterId":"f","aggregationId":1,"calculation":"AVG","instant":true,"reducer":"max"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	checkInstant(res.Frames[0], 3, 2)
+}
+
+func TestQueryDataUpstreamBody(t *testing.T) {
+	var body []byte
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte(testMetrics))
+	})
+	defer srv.Close()
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := newTestHandler(t, srv.URL).QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID:     "A",
+		Interval:  time.Minute,
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		JSON:      []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","useGroupingAliases":true,"legendFormat":"{{os}}","format":"multi","reducer":"max","grouping_filter_mapping":{"os":{"id":"$__agg"}}}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"filterId":"f","startTime":"2024-01-01T00:00:00Z","endTime":"2024-01-01T01:00:00Z","groupingFilters":[{"grouping":"os","filters":["$__agg"],"returnGroupingValues":false}],"aggregationId":1,"calculation":"COUNT","limit":null,"limitType":null,"alias":"","excludeEmptyGroupings":false,"hide":null,"filterDefinitionName":"Logins","longResult":null,"includeGroupingLabels":false,"groupingName":"","mode":"","includeAggregateOption":false,"includeIncompleteIntervals":false,"percentile":null,"optimized":true,"queryId":"A","fast_mode":false,"shouldRecalculate":false,"recalculatedInterval":null}]`
+	if string(body) != want {
+		t.Errorf("expected only the options of the API to be sent, got\n%s", body)
+	}
+}
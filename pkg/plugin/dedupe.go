@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// duplicateQueries tracks queries of a request that only differ in their refID.
+// The first query asked for is sent upstream, its response is copied to the others.
+type duplicateQueries struct {
+	leaders    map[string]string
+	duplicates map[string][]string
+}
+
+func newDuplicateQueries() *duplicateQueries {
+	return &duplicateQueries{leaders: make(map[string]string), duplicates: make(map[string][]string)}
+}
+
+// add registers qo and reports whether an identical query was registered before.
+func (dq *duplicateQueries) add(qo QueryOptions) bool {
+	key := dedupeKey(qo)
+	leader, ok := dq.leaders[key]
+	if !ok {
+		dq.leaders[key] = qo.QueryId
+		return false
+	}
+	dq.duplicates[leader] = append(dq.duplicates[leader], qo.QueryId)
+	return true
+}
+
+// fanOut copies the response of every sent query to its duplicates. Frames are shallow
+// copies sharing their fields, which are never modified once built.
+func (dq *duplicateQueries) fanOut(response *backend.QueryDataResponse) {
+	for leader, dups := range dq.duplicates {
+		res, ok := response.Responses[leader]
+		if !ok {
+			continue
+		}
+		for _, id := range dups {
+			copied := res
+			copied.Frames = make(data.Frames, len(res.Frames))
+			for i, f := range res.Frames {
+				frame := *f
+				frame.RefID = id
+				copied.Frames[i] = &frame
+			}
+			setCustomMeta(copied.Frames, func(m *frameCustomMeta) {
+				m.DeduplicatedFrom = leader
+			})
+			response.Responses[id] = copied
+		}
+	}
+}
+
+// dedupeKey identifies a query by all its options but the refID.
+func dedupeKey(qo QueryOptions) string {
+	qo.QueryId = ""
+	b, _ := json.Marshal(struct {
+		QueryOptions
+		Interval     time.Duration
+		SeriesLabels data.Labels
+	}{qo, qo.Interval, qo.SeriesLabels})
+	return string(b)
+}
@@ -0,0 +1,342 @@
+package handler
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+// A query asking for several series of the same filter, such as a list of aggregations
+// or calculations, is expanded into a sub query per series. Sub queries are planned, batched and cached
+// like any other query, their frames are joined back into a single frame for the query.
+
+// subQuerySeparator separates the refID of a query from the series of its sub queries.
+const subQuerySeparator = "#"
+
+// The labels telling the aggregations and calculations of a query apart.
+const (
+	aggregationLabel = "aggregation"
+	calculationLabel = "calculation"
+)
+
+// expandQuery returns the sub queries of qo, or qo alone when it asks for a single series.
+// Sub queries get a refID derived from the one of qo.
+func expandQuery(qo QueryOptions) []QueryOptions {
+	if qo.Mode == ratioMode {
+		return expandRatio(qo)
+	}
+	var subs []QueryOptions
+	for _, agg := range expandAggregations(qo) {
+		for _, sub := range expandCalculations(agg) {
+			sub.AggregationIds = nil
+			sub.Calculations = nil
+			sub.Percentiles = nil
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// aggregationIds returns the aggregations qo asks for.
+func (qo QueryOptions) aggregationIds() []int {
+	if len(qo.AggregationIds) == 0 {
+		return []int{qo.AggregationId}
+	}
+	return qo.AggregationIds
+}
+
+// expandAggregations returns a query per aggregation.
+func expandAggregations(qo QueryOptions) []QueryOptions {
+	var subs []QueryOptions
+	for _, id := range qo.aggregationIds() {
+		if slices.ContainsFunc(subs, func(o QueryOptions) bool { return o.AggregationId == id }) {
+			continue
+		}
+		sub := qo
+		sub.AggregationId = id
+		if name, ok := qo.AggregationNames[id]; ok {
+			sub.AggregationName = name
+		}
+		subs = append(subs, sub)
+	}
+	if len(subs) > 1 {
+		for i := range subs {
+			name := subs[i].AggregationName
+			if name == "" {
+				name = strconv.Itoa(subs[i].AggregationId)
+			}
+			subs[i].QueryId += subQuerySeparator + strconv.Itoa(subs[i].AggregationId)
+			subs[i].SeriesLabels = withLabel(subs[i].SeriesLabels, aggregationLabel, name)
+		}
+	}
+	return subs
+}
+
+// expandCalculations returns a query per calculation, and per percentile for PERCENTILES.
+func expandCalculations(qo QueryOptions) []QueryOptions {
+	calcs := qo.Calculations
+	if len(calcs) == 0 {
+		calcs = []Calculation{qo.Calculation}
+	}
+	var subs []QueryOptions
+	for _, c := range calcs {
+		percentiles := []null.Float{qo.Percentile}
+		if c == PERCENTILES && len(qo.Percentiles) > 0 {
+			percentiles = percentiles[:0]
+			for _, p := range qo.Percentiles {
+				percentiles = append(percentiles, null.FloatFrom(p))
+			}
+		}
+		for _, p := range percentiles {
+			sub := qo
+			sub.Calculation = c
+			sub.Percentile = p
+			if !slices.ContainsFunc(subs, func(o QueryOptions) bool { return calculationName(o) == calculationName(sub) }) {
+				subs = append(subs, sub)
+			}
+		}
+	}
+	if len(subs) > 1 {
+		for i := range subs {
+			subs[i].QueryId += subQuerySeparator + calculationName(subs[i])
+			subs[i].SeriesLabels = withLabel(subs[i].SeriesLabels, calculationLabel, calculationName(subs[i]))
+		}
+	}
+	return subs
+}
+
+// withLabel returns a copy of labels with k set to v, sub queries must not share them.
+func withLabel(labels data.Labels, k string, v string) data.Labels {
+	labels = maps.Clone(labels)
+	if labels == nil {
+		labels = make(data.Labels)
+	}
+	labels[k] = v
+	return labels
+}
+
+// calculationName names the calculation of qo, percentiles as p95 or p99.9.
+func calculationName(qo QueryOptions) string {
+	if qo.Calculation != PERCENTILES || !qo.Percentile.Valid {
+		return string(qo.Calculation)
+	}
+	return "p" + strconv.FormatFloat(math.Round(qo.Percentile.Float64*1e6)/1e4, 'f', -1, 64)
+}
+
+// validPercentiles reports whether the percentiles qo asks for are within (0, 1].
+func validPercentiles(qo QueryOptions) bool {
+	for _, sub := range expandQuery(qo) {
+		if sub.Calculation == PERCENTILES && (!sub.Percentile.Valid || sub.Percentile.Float64 <= 0 || sub.Percentile.Float64 > 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandedQueries remembers the queries of a request that were expanded into sub queries.
+type expandedQueries struct {
+	parents []QueryOptions
+	subs    map[string][]string
+}
+
+func newExpandedQueries() *expandedQueries {
+	return &expandedQueries{subs: make(map[string][]string)}
+}
+
+func (e *expandedQueries) add(parent QueryOptions, subs []QueryOptions) {
+	e.parents = append(e.parents, parent)
+	for _, sub := range subs {
+		e.subs[parent.QueryId] = append(e.subs[parent.QueryId], sub.QueryId)
+	}
+}
+
+// join replaces the responses of sub queries with a response for the query they were
+// expanded from. Frames are joined into one, or divided for ratio queries, an error of
+// any sub query is reported. num_combined is the number of fast mode queries of the
+// request, see queryMulti.
+func (e *expandedQueries) join(response *backend.QueryDataResponse, num_combined int) {
+	for _, parent := range e.parents {
+		var joined backend.DataResponse
+		var subs []backend.DataResponse
+		var frames data.Frames
+		var errs []error
+		for _, id := range e.subs[parent.QueryId] {
+			res := response.Responses[id]
+			delete(response.Responses, id)
+			if res.Error != nil {
+				if joined.Error == nil {
+					joined.Status = res.Status
+				}
+				errs = append(errs, res.Error)
+			}
+			subs = append(subs, res)
+			frames = append(frames, res.Frames...)
+		}
+		if len(errs) > 0 {
+			joined.Error = errors.Join(slices.CompactFunc(errs, func(a, b error) bool { return a.Error() == b.Error() })...)
+		}
+		if parent.Mode != ratioMode {
+			joined.Frames = joinFrames(frames)
+		} else if joined.Error == nil {
+			num_queries := 1
+			if parent.FastMode {
+				num_queries = num_combined
+			}
+			joined = ratioResponse(parent, subs[0], subs[1], num_queries)
+		}
+		response.Responses[parent.QueryId] = joined
+	}
+}
+
+// joinFrames joins the frames of sub queries, all wide or all long. Wide frames are
+// aligned on their time, long frames and numeric tables on their time and grouping
+// columns. Values missing from a sub query are null. Frames that can't be aligned are returned as they are.
+func joinFrames(frames data.Frames) data.Frames {
+	if len(frames) < 2 || frames[0].Meta != nil && (frames[0].Meta.Type == data.FrameTypeTimeSeriesMulti || frames[0].Meta.Type == data.FrameTypeNumericMulti) {
+		// a frame per series already
+		return frames
+	}
+	type column struct {
+		field  *data.Field
+		row_of []int
+	}
+	type row struct {
+		keys  data.Fields
+		index int
+	}
+	var rows []row
+	index := make(map[string]int)
+	var keyFields data.Fields
+	var columns []column
+	for _, frame := range frames {
+		keys, vals := splitJoinFields(frame)
+		if keyFields == nil {
+			keyFields = keys
+		} else if !sameKeyFields(keyFields, keys) {
+			return frames
+		}
+		row_of := make([]int, frame.Rows())
+		for r := range row_of {
+			key := joinKey(keys, r)
+			i, ok := index[key]
+			if !ok {
+				i = len(rows)
+				index[key] = i
+				rows = append(rows, row{keys: keys, index: r})
+			}
+			row_of[r] = i
+		}
+		for _, f := range vals {
+			columns = append(columns, column{field: f, row_of: row_of})
+		}
+	}
+
+	// position[i] is where the i-th joined row goes once sorted by time
+	order := make([]int, len(rows))
+	for i := range order {
+		order[i] = i
+	}
+	if len(keyFields) > 0 && keyFields[0].Type() == data.FieldTypeTime {
+		rowTime := func(i int) time.Time { return rows[i].keys[0].At(rows[i].index).(time.Time) }
+		slices.SortStableFunc(order, func(a, b int) int { return rowTime(a).Compare(rowTime(b)) })
+	}
+	position := make([]int, len(rows))
+	for i, r := range order {
+		position[r] = i
+	}
+
+	fields := make(data.Fields, 0, len(keyFields)+len(columns))
+	for k, f := range keyFields {
+		field := data.NewFieldFromFieldType(f.Type(), len(rows))
+		field.Name = f.Name
+		field.Labels = f.Labels
+		field.Config = f.Config
+		for i, r := range order {
+			field.Set(i, rows[r].keys[k].CopyAt(rows[r].index))
+		}
+		fields = append(fields, field)
+	}
+	for _, c := range columns {
+		values := make([]*float64, len(rows))
+		for r, i := range c.row_of {
+			values[position[i]], _ = c.field.NullableFloatAt(r)
+		}
+		field := data.NewField(c.field.Name, c.field.Labels, values)
+		field.Config = c.field.Config
+		fields = append(fields, field)
+	}
+
+	joined := data.NewFrame(frames[0].Name, fields...)
+	joined.RefID = frames[0].RefID
+	joined.Meta = joinMeta(frames)
+	return data.Frames{joined}
+}
+
+// splitJoinFields splits the fields of a frame into the fields rows are aligned on and
+// the value fields. Wide frames are aligned on their time only.
+func splitJoinFields(frame *data.Frame) (keys data.Fields, values data.Fields) {
+	if frame.Meta != nil && frame.Meta.Type == data.FrameTypeTimeSeriesWide {
+		return frame.Fields[:1], frame.Fields[1:]
+	}
+	return frame.Fields[:len(frame.Fields)-1], frame.Fields[len(frame.Fields)-1:]
+}
+
+func sameKeyFields(a data.Fields, b data.Fields) bool {
+	return slices.EqualFunc(a, b, func(x, y *data.Field) bool {
+		return x.Name == y.Name && x.Type() == y.Type()
+	})
+}
+
+// joinKey identifies row r by its key fields, the time first and then grouping values.
+func joinKey(keys data.Fields, r int) string {
+	var sb strings.Builder
+	for _, f := range keys {
+		switch v := f.At(r).(type) {
+		case time.Time:
+			sb.WriteString(strconv.FormatInt(v.UnixNano(), 10))
+		case string:
+			sb.WriteString(strconv.Quote(v))
+		}
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// joinMeta merges the meta of the joined frames. The executed query strings of all
+// batches involved are kept, the cache status is partial when it differs between frames.
+func joinMeta(frames data.Frames) *data.FrameMeta {
+	if frames[0].Meta == nil {
+		return nil
+	}
+	meta := *frames[0].Meta
+	var executed []string
+	custom := frameCustomMeta{}
+	for i, f := range frames {
+		if f.Meta == nil {
+			continue
+		}
+		if f.Meta.ExecutedQueryString != "" && !slices.Contains(executed, f.Meta.ExecutedQueryString) {
+			executed = append(executed, f.Meta.ExecutedQueryString)
+		}
+		if m, ok := f.Meta.Custom.(*frameCustomMeta); ok {
+			if i == 0 {
+				custom = *m
+			} else if m.Cache != custom.Cache {
+				custom.Cache = cachePartial
+			}
+		}
+	}
+	meta.ExecutedQueryString = strings.Join(executed, "\n\n")
+	if frames[0].Meta.Custom != nil {
+		meta.Custom = &custom
+	}
+	return &meta
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+// seriesServer answers metrics/results with series depending on the calculation of
+// each query: COUNT has ios and android at 00:00, valued at the aggregation id and twice
+// that, AVG has ios at 00:01 and PERCENTILES has ios at 00:00 valued at the percentile.
+func seriesServer(calls *atomic.Int32) *httptest.Server {
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		var rows []string
+		separator := func(os string, id string) string {
+			return fmt.Sprintf(`{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":%q,"country":"US"},"queryId":%q}`, os, id)
+		}
+		for _, qo := range qos {
+			switch qo.Calculation {
+			case COUNT:
+				rows = append(rows, separator("ios", qo.QueryId), fmt.Sprintf(`{"dtSecLater":0,"val":%d,"queryId":%q}`, qo.AggregationId, qo.QueryId),
+					separator("android", qo.QueryId), fmt.Sprintf(`{"dtSecLater":0,"val":%d,"queryId":%q}`, 2*qo.AggregationId, qo.QueryId))
+			case AVG:
+				rows = append(rows, separator("ios", qo.QueryId), fmt.Sprintf(`{"dtSecLater":60,"val":0.5,"queryId":%q}`, qo.QueryId))
+			case PERCENTILES:
+				rows = append(rows, separator("ios", qo.QueryId), fmt.Sprintf(`{"dtSecLater":0,"val":%v,"queryId":%q}`, qo.Percentile.Float64, qo.QueryId))
+			}
+		}
+		w.Write([]byte("[" + strings.Join(rows, ",") + "]"))
+	})
+	return srv
+}
+
+func TestExpandQuery(t *testing.T) {
+	qo := QueryOptions{QueryId: "A", Calculations: []Calculation{COUNT, PERCENTILES, COUNT}, Percentiles: []float64{0.5, 0.999}}
+	var ids []string
+	for _, sub := range expandQuery(qo) {
+		ids = append(ids, sub.QueryId)
+		if sub.Calculations != nil || sub.Percentiles != nil {
+			t.Errorf("%s: sub queries must ask for a single calculation", sub.QueryId)
+		}
+		if sub.SeriesLabels[calculationLabel] == "" {
+			t.Errorf("%s: missing calculation label", sub.QueryId)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "A#COUNT,A#p50,A#p99.9" {
+		t.Errorf("got sub queries %s", got)
+	}
+
+	qo = QueryOptions{QueryId: "A", AggregationIds: []int{1, 2}, Calculations: []Calculation{COUNT, AVG}, AggregationNames: map[int]string{1: "All"}}
+	ids = nil
+	for _, sub := range expandQuery(qo) {
+		ids = append(ids, sub.QueryId+" "+sub.SeriesLabels[aggregationLabel])
+	}
+	if got := strings.Join(ids, ","); got != "A#1#COUNT All,A#1#AVG All,A#2#COUNT 2,A#2#AVG 2" {
+		t.Errorf("got sub queries %s", got)
+	}
+
+	single := expandQuery(QueryOptions{QueryId: "A", Calculations: []Calculation{PERCENTILES}, Percentile: null.FloatFrom(0.9)})
+	if len(single) != 1 || single[0].QueryId != "A" || single[0].Calculation != PERCENTILES || single[0].SeriesLabels != nil {
+		t.Errorf("a single calculation must not be expanded, got %+v", single)
+	}
+}
+
+func TestQueryDataCalculations(t *testing.T) {
+	var calls atomic.Int32
+	srv := seriesServer(&calls)
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(refID string, options string) backend.DataQuery {
+		return backend.DataQuery{
+			RefID:     refID,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":1,"fast_mode":true,"calculations":["COUNT","AVG"],` + options + `}`),
+		}
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{
+		query("A", `"includeGroupingLabels":true`),
+		query("B", `"longResult":true`),
+		query("C", `"calculations":["PERCENTILES"],"percentiles":[0.5,0.95]`),
+		query("D", `"calculations":["COUNT","MAX"]`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the sub queries in a single call, got %d", n)
+	}
+	if len(resp.Responses) != 4 {
+		t.Errorf("expected a response per query, got %v", resp.Responses)
+	}
+
+	a := resp.Responses["A"]
+	if a.Error != nil || len(a.Frames) != 1 {
+		t.Fatalf("A: expected a single frame, got %v", a)
+	}
+	wide := a.Frames[0]
+	if wide.Meta.Type != data.FrameTypeTimeSeriesWide || len(wide.Fields) != 4 || wide.Rows() != 2 {
+		t.Fatalf("A: unexpected frame %v", frameTable(wide))
+	}
+	wantNames := []string{"Logins: calculation=COUNT, country=US, os=android", "Logins: calculation=COUNT, country=US, os=ios", "Logins: calculation=AVG, country=US, os=ios"}
+	for i, want := range wantNames {
+		if got := wide.Fields[i+1].Config.DisplayNameFromDS; got != want {
+			t.Errorf("A: field %d named %q, want %q", i+1, got, want)
+		}
+	}
+	if v, _ := wide.Fields[3].NullableFloatAt(0); v != nil {
+		t.Errorf("A: AVG has no value at 00:00, got %v", *v)
+	}
+	if v, _ := wide.Fields[3].NullableFloatAt(1); v == nil || *v != 0.5 {
+		t.Errorf("A: AVG at 00:01 should be 0.5, got %v", v)
+	}
+
+	long := resp.Responses["B"].Frames[0]
+	if len(long.Fields) != 5 || long.Rows() != 3 {
+		t.Fatalf("B: unexpected frame %v", frameTable(long))
+	}
+	for r, want := range []string{"ios 1 <nil>", "android 2 <nil>", "ios <nil> 0.5"} {
+		count, _ := long.Fields[3].NullableFloatAt(r)
+		avg, _ := long.Fields[4].NullableFloatAt(r)
+		if got := fmt.Sprintf("%v %v %v", long.Fields[1].At(r), deref(count), deref(avg)); got != want {
+			t.Errorf("B: row %d is %q, want %q", r, got, want)
+		}
+	}
+
+	c := resp.Responses["C"].Frames[0]
+	if len(c.Fields) != 3 || c.Fields[1].Labels[calculationLabel] != "p50" || c.Fields[2].Labels[calculationLabel] != "p95" {
+		t.Errorf("C: expected a field per percentile, got %v", frameTable(c))
+	}
+
+	if err := resp.Responses["D"].Error; err == nil || !strings.Contains(err.Error(), "MAX") {
+		t.Errorf("D: expected a validation error for MAX, got %v", err)
+	}
+}
+
+func deref(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func frameTable(f *data.Frame) string {
+	s, _ := f.StringTable(-1, -1)
+	return s
+}
+
+func TestQueryDataAggregations(t *testing.T) {
+	var calls atomic.Int32
+	srv := seriesServer(&calls)
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{
+		{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationIds":[1,2],"calculation":"COUNT","legendFormat":"{{__aggregation}} {{os}}"}`),
+		},
+		{
+			RefID:     "B",
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationIds":[1,2],"calculation":"AVG"}`),
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the aggregations in a single call, got %d", n)
+	}
+
+	a := resp.Responses["A"]
+	if a.Error != nil || len(a.Frames) != 1 {
+		t.Fatalf("A: expected a single frame, got %v", a)
+	}
+	frame := a.Frames[0]
+	var got []string
+	for _, f := range frame.Fields[1:] {
+		v, _ := f.NullableFloatAt(0)
+		got = append(got, fmt.Sprintf("%s=%v", f.Config.DisplayNameFromDS, deref(v)))
+	}
+	if s := strings.Join(got, ", "); s != "All android=2, All ios=1, Failed android=4, Failed ios=2" {
+		t.Errorf("A: got %s", s)
+	}
+
+	if err := resp.Responses["B"].Error; err == nil || !strings.Contains(err.Error(), `aggregation "Failed"`) {
+		t.Errorf("B: expected AVG to be rejected for aggregation Failed, got %v", err)
+	}
+}
@@ -0,0 +1,582 @@
+package handler
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// expressionMode queries compute a math expression over the series of other queries of
+// the same request, e.g. "(A - B) / A * 100". Series of both sides of an operator are
+// matched on their labels like PromQL one-to-one vector matching, "A / on(os) B" and
+// "A / ignoring(calculation) B" restrict the labels matched on, the result only keeps
+// the labels matched on.
+const expressionMode = "expression"
+
+// ExpressionSyntaxError reports an expression that can't be parsed.
+type ExpressionSyntaxError struct {
+	Expression string
+	Pos        int
+	Msg        string
+}
+
+func (e *ExpressionSyntaxError) Error() string {
+	return fmt.Sprintf("expression %q: %s at position %d", e.Expression, e.Msg, e.Pos)
+}
+
+// UnknownRefIDError reports an expression referring to a query that isn't part of the request.
+type UnknownRefIDError struct {
+	RefID string
+}
+
+func (e *UnknownRefIDError) Error() string {
+	return fmt.Sprintf("expression refers to unknown query %q", e.RefID)
+}
+
+// UnsupportedFormatError reports an expression referring to a query without a time
+// field, as instant and numeric queries are, its format being the type of its frame.
+type UnsupportedFormatError struct {
+	RefID  string
+	Format string
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("expression refers to query %q of format %q, only time series can be combined", e.RefID, e.Format)
+}
+
+// LabelMismatchError reports operands of which no series have matching labels.
+type LabelMismatchError struct {
+	Op    string
+	Left  []data.Labels
+	Right []data.Labels
+}
+
+func (e *LabelMismatchError) Error() string {
+	return fmt.Sprintf("no series match on both sides of %q: left has %s, right has %s", e.Op, labelSets(e.Left), labelSets(e.Right))
+}
+
+// DuplicateMatchError reports several series of an operand with the same matching
+// labels, only one-to-one matching is supported.
+type DuplicateMatchError struct {
+	Op     string
+	Labels string
+}
+
+func (e *DuplicateMatchError) Error() string {
+	return fmt.Sprintf("several series match %s on the same side of %q, use on() or ignoring() to tell them apart", e.Labels, e.Op)
+}
+
+func labelSets(sets []data.Labels) string {
+	names := make([]string, len(sets))
+	for i, l := range sets {
+		names[i] = "{" + l.String() + "}"
+	}
+	return strings.Join(names, ", ")
+}
+
+// exprNode is a node of a parsed expression.
+type exprNode interface {
+	eval(env exprEnv) (exprValue, error)
+}
+
+// exprEnv holds the series of the queries an expression may refer to.
+type exprEnv func(refID string) ([]exprSeries, error)
+
+// exprValue is a scalar, or a set of series when series is not nil.
+type exprValue struct {
+	scalar float64
+	series []exprSeries
+}
+
+// exprSeries is a series of an expression, its values keyed by unix nanoseconds.
+type exprSeries struct {
+	labels data.Labels
+	points map[int64]float64
+}
+
+type numberNode float64
+
+type refNode string
+
+type negNode struct {
+	x exprNode
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+	// on and labels restrict the labels series are matched on, see vectorMatching
+	on       bool
+	ignoring bool
+	labels   []string
+}
+
+func (n numberNode) eval(exprEnv) (exprValue, error) {
+	return exprValue{scalar: float64(n)}, nil
+}
+
+func (n refNode) eval(env exprEnv) (exprValue, error) {
+	series, err := env(string(n))
+	if err != nil {
+		return exprValue{}, err
+	}
+	if series == nil {
+		series = []exprSeries{}
+	}
+	return exprValue{series: series}, nil
+}
+
+func (n negNode) eval(env exprEnv) (exprValue, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return exprValue{}, err
+	}
+	return apply('*', exprValue{scalar: -1}, v), nil
+}
+
+func (n binaryNode) eval(env exprEnv) (exprValue, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return exprValue{}, err
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if l.series == nil || r.series == nil {
+		return apply(n.op, l, r), nil
+	}
+
+	right := make(map[string]exprSeries, len(r.series))
+	for _, s := range r.series {
+		key := n.matchLabels(s.labels).String()
+		if _, ok := right[key]; ok {
+			return exprValue{}, &DuplicateMatchError{Op: string(n.op), Labels: "{" + key + "}"}
+		}
+		right[key] = s
+	}
+	seen := make(map[string]bool, len(l.series))
+	out := exprValue{series: []exprSeries{}}
+	for _, ls := range l.series {
+		match := n.matchLabels(ls.labels)
+		key := match.String()
+		if seen[key] {
+			return exprValue{}, &DuplicateMatchError{Op: string(n.op), Labels: "{" + key + "}"}
+		}
+		seen[key] = true
+		rs, ok := right[key]
+		if !ok {
+			continue
+		}
+		labels := ls.labels
+		if n.on || n.ignoring {
+			labels = match
+		}
+		res := exprSeries{labels: labels, points: make(map[int64]float64, len(ls.points))}
+		for t, lv := range ls.points {
+			if rv, ok := rs.points[t]; ok {
+				res.points[t] = arithmetic(n.op, lv, rv)
+			}
+		}
+		out.series = append(out.series, res)
+	}
+	if len(out.series) == 0 && len(l.series) > 0 && len(r.series) > 0 {
+		return exprValue{}, &LabelMismatchError{Op: string(n.op), Left: seriesLabels(l.series), Right: seriesLabels(r.series)}
+	}
+	return out, nil
+}
+
+// matchLabels returns the labels series are matched on: all of them, those listed by
+// on(), or all but those listed by ignoring().
+func (n binaryNode) matchLabels(labels data.Labels) data.Labels {
+	if !n.on && !n.ignoring {
+		return labels
+	}
+	match := make(data.Labels, len(labels))
+	for k, v := range labels {
+		if slices.Contains(n.labels, k) == n.on {
+			match[k] = v
+		}
+	}
+	return match
+}
+
+func seriesLabels(series []exprSeries) []data.Labels {
+	labels := make([]data.Labels, len(series))
+	for i, s := range series {
+		labels[i] = s.labels
+	}
+	return labels
+}
+
+// apply applies op when at least one side is a scalar.
+func apply(op byte, l exprValue, r exprValue) exprValue {
+	if l.series == nil && r.series == nil {
+		return exprValue{scalar: arithmetic(op, l.scalar, r.scalar)}
+	}
+	vector, scalarLeft := r, true
+	if l.series != nil {
+		vector, scalarLeft = l, false
+	}
+	out := exprValue{series: make([]exprSeries, len(vector.series))}
+	for i, s := range vector.series {
+		res := exprSeries{labels: s.labels, points: make(map[int64]float64, len(s.points))}
+		for t, v := range s.points {
+			if scalarLeft {
+				res.points[t] = arithmetic(op, l.scalar, v)
+			} else {
+				res.points[t] = arithmetic(op, v, r.scalar)
+			}
+		}
+		out.series[i] = res
+	}
+	return out
+}
+
+// arithmetic follows IEEE 754, dividing by zero gives an infinity or NaN.
+func arithmetic(op byte, l float64, r float64) float64 {
+	switch op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// parseExpression parses an expression, returning the refIDs it refers to.
+func parseExpression(expression string) (exprNode, []string, error) {
+	p := &exprParser{src: expression}
+	node, err := p.expr()
+	if err == nil {
+		p.space()
+		if p.pos < len(p.src) {
+			err = p.errorf("unexpected %q", p.src[p.pos:])
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return node, p.refs, nil
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	refs []string
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return &ExpressionSyntaxError{Expression: p.src, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *exprParser) space() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.space()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// expr := term (("+" | "-") matching term)*
+func (p *exprParser) expr() (exprNode, error) {
+	return p.binary("+-", p.term)
+}
+
+// term := unary (("*" | "/") matching unary)*
+func (p *exprParser) term() (exprNode, error) {
+	return p.binary("*/", p.unary)
+}
+
+func (p *exprParser) binary(ops string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peek(); c != 0 && strings.IndexByte(ops, c) >= 0; c = p.peek() {
+		p.pos++
+		node := binaryNode{op: c, left: left}
+		if err := p.matching(&node); err != nil {
+			return nil, err
+		}
+		if node.right, err = operand(); err != nil {
+			return nil, err
+		}
+		left = node
+	}
+	return left, nil
+}
+
+// matching := [("on" | "ignoring") "(" [ident ("," ident)*] ")"]
+func (p *exprParser) matching(node *binaryNode) error {
+	p.space()
+	start := p.pos
+	word := p.ident()
+	if (word != "on" && word != "ignoring") || p.peek() != '(' {
+		p.pos = start
+		return nil
+	}
+	node.on, node.ignoring = word == "on", word == "ignoring"
+	p.pos++
+	node.labels = []string{}
+	for p.peek() != ')' {
+		if len(node.labels) > 0 {
+			if p.peek() != ',' {
+				return p.errorf("expected , or ) in %s()", word)
+			}
+			p.pos++
+			p.space()
+		}
+		label := p.ident()
+		if label == "" {
+			return p.errorf("expected a label in %s()", word)
+		}
+		node.labels = append(node.labels, label)
+	}
+	p.pos++
+	return nil
+}
+
+// unary := "-" unary | primary
+func (p *exprParser) unary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x: x}, nil
+	}
+	return p.primary()
+}
+
+// primary := number | ["$"] refID | "(" expr ")"
+func (p *exprParser) primary() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return node, nil
+	case c == '.' || c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number")
+		}
+		return numberNode(v), nil
+	case c == '$':
+		p.pos++
+	}
+	ref := p.ident()
+	if ref == "" {
+		if c == 0 {
+			return nil, p.errorf("unexpected end of expression")
+		}
+		return nil, p.errorf("unexpected %q", string(c))
+	}
+	if !slices.Contains(p.refs, ref) {
+		p.refs = append(p.refs, ref)
+	}
+	return refNode(ref), nil
+}
+
+func (p *exprParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := rune(p.src[p.pos])
+		if !(unicode.IsLetter(c) || c == '_' || p.pos > start && unicode.IsDigit(c)) {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// seriesFromFrames reads the series of a query from its frames. Every numeric field is
+// a series per combination of the string fields of the frame, labelled with them and
+// the labels of the field, so wide and long frames give the same series. Frames without
+// a time field can't be combined, they are an UnsupportedFormatError.
+func seriesFromFrames(refID string, frames data.Frames) ([]exprSeries, error) {
+	var series []exprSeries
+	index := make(map[string]int)
+	for _, frame := range frames {
+		timeField := -1
+		var groupings, values []int
+		for i, f := range frame.Fields {
+			switch {
+			case f.Type().Time() && timeField < 0:
+				timeField = i
+			case f.Type() == data.FieldTypeString:
+				groupings = append(groupings, i)
+			case f.Type().Numeric():
+				values = append(values, i)
+			}
+		}
+		if timeField < 0 {
+			if len(frame.Fields) == 0 {
+				continue
+			}
+			format := "unknown"
+			if frame.Meta != nil && frame.Meta.Type != "" {
+				format = string(frame.Meta.Type)
+			}
+			return nil, &UnsupportedFormatError{RefID: refID, Format: format}
+		}
+		for r := 0; r < frame.Rows(); r++ {
+			t, ok := frame.Fields[timeField].ConcreteAt(r)
+			if !ok {
+				continue
+			}
+			for _, v := range values {
+				value, err := frame.Fields[v].NullableFloatAt(r)
+				if err != nil || value == nil {
+					continue
+				}
+				labels := make(data.Labels)
+				for _, g := range groupings {
+					labels[frame.Fields[g].Name] = frame.Fields[g].At(r).(string)
+				}
+				for k, lv := range frame.Fields[v].Labels {
+					labels[k] = lv
+				}
+				key := labels.String()
+				i, ok := index[key]
+				if !ok {
+					i = len(series)
+					index[key] = i
+					series = append(series, exprSeries{labels: labels, points: make(map[int64]float64)})
+				}
+				series[i].points[t.(time.Time).UnixNano()] = *value
+			}
+		}
+	}
+	return series, nil
+}
+
+// expressionFrame builds the wide frame of the series an expression evaluated to.
+func expressionFrame(qo QueryOptions, series []exprSeries) *data.Frame {
+	var times []int64
+	for _, s := range series {
+		for t := range s.points {
+			times = append(times, t)
+		}
+	}
+	slices.Sort(times)
+	times = slices.Compact(times)
+	slices.SortFunc(series, func(a, b exprSeries) int { return strings.Compare(a.labels.String(), b.labels.String()) })
+
+	name := qo.Alias
+	if name == "" {
+		name = qo.Expression
+	}
+	var legend legendTemplate
+	if qo.LegendFormat != "" {
+		legend = parseLegend(qo.LegendFormat)
+	}
+	col := make([]time.Time, len(times))
+	for i, t := range times {
+		col[i] = time.Unix(0, t).UTC()
+	}
+	fields := data.Fields{data.NewField("time", nil, col)}
+	for _, s := range series {
+		values := make([]*float64, len(times))
+		for i, t := range times {
+			if v, ok := s.points[t]; ok {
+				values[i] = &v
+			}
+		}
+		field := data.NewField(name, s.labels, values)
+		if dn := displayName(qo, legend, s.labels, 1); dn != "" {
+			field.Config = &data.FieldConfig{DisplayNameFromDS: dn}
+		}
+		fields = append(fields, field)
+	}
+	frame := data.NewFrame("Expression", fields...)
+	frame.Meta = &data.FrameMeta{
+		Type:                data.FrameTypeTimeSeriesWide,
+		TypeVersion:         data.FrameTypeVersion{0, 1},
+		ExecutedQueryString: "expression: " + qo.Expression,
+	}
+	return frame
+}
+
+// expressionQuery is a parsed expression query of a request.
+type expressionQuery struct {
+	qo   QueryOptions
+	node exprNode
+	refs []string
+}
+
+// evaluateExpressions computes the expression queries of a request from the responses
+// of the other queries, expressions may refer to each other.
+func evaluateExpressions(expressions []expressionQuery, response *backend.QueryDataResponse) {
+	byRefID := make(map[string]expressionQuery, len(expressions))
+	for _, e := range expressions {
+		byRefID[e.qo.QueryId] = e
+	}
+	evaluating := make(map[string]bool)
+	var evaluate func(e expressionQuery) backend.DataResponse
+	env := func(refID string) ([]exprSeries, error) {
+		if e, ok := byRefID[refID]; ok {
+			if evaluating[refID] {
+				return nil, fmt.Errorf("expression %q refers to itself", refID)
+			}
+			if _, done := response.Responses[refID]; !done {
+				response.Responses[refID] = evaluate(e)
+			}
+		}
+		res, ok := response.Responses[refID]
+		if !ok {
+			return nil, &UnknownRefIDError{RefID: refID}
+		}
+		if res.Error != nil {
+			return nil, fmt.Errorf("query %q failed: %w", refID, res.Error)
+		}
+		return seriesFromFrames(refID, res.Frames)
+	}
+	evaluate = func(e expressionQuery) backend.DataResponse {
+		evaluating[e.qo.QueryId] = true
+		defer delete(evaluating, e.qo.QueryId)
+		v, err := e.node.eval(env)
+		if err != nil {
+			return backend.DataResponse{Status: backend.StatusBadRequest, Error: fmt.Errorf("expression %q: %w", e.qo.QueryId, err)}
+		}
+		if v.series == nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("expression %q doesn't refer to any query", e.qo.QueryId))
+		}
+		return backend.DataResponse{Frames: data.Frames{expressionFrame(e.qo, v.series)}}
+	}
+	for _, e := range expressions {
+		if _, done := response.Responses[e.qo.QueryId]; !done {
+			response.Responses[e.qo.QueryId] = evaluate(e)
+		}
+	}
+}
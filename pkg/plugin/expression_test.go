@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestParseExpression(t *testing.T) {
+	for expression, refs := range map[string]string{
+		"(A - B) / A * 100":            "A,B",
+		"A * 60":                       "A",
+		"-$A + .5":                     "A",
+		"errors / on(os, country) all": "errors,all",
+		"A / ignoring() B":             "A,B",
+		"on * 2":                       "on",
+	} {
+		_, got, err := parseExpression(expression)
+		if err != nil {
+			t.Errorf("%q: %v", expression, err)
+		} else if strings.Join(got, ",") != refs {
+			t.Errorf("%q: got refs %v, want %s", expression, got, refs)
+		}
+	}
+	for _, expression := range []string{"", "A +", "(A", "A B", "A / on(os B", "1.2.3", "A % B", "A / on(,) B"} {
+		var syntaxErr *ExpressionSyntaxError
+		if _, _, err := parseExpression(expression); !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected a syntax error, got %v", expression, err)
+		}
+	}
+}
+
+// exprResponse is a response with a wide frame of a series per os, valued v and 2*v at
+// 00:00 and 00:01, labelled with labels as well.
+func exprResponse(v float64, labels data.Labels, os ...string) backend.DataResponse {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	res := &queryResult{HasData: true, Groupings: []string{"os"}, GroupingValues: [][]string{nil}}
+	for i := 0; i < 2; i++ {
+		for _, o := range os {
+			res.Times = append(res.Times, start.Add(time.Duration(i)*time.Minute))
+			res.Values = append(res.Values, v*float64(i+1))
+			res.GroupingValues[0] = append(res.GroupingValues[0], o)
+		}
+	}
+	return backend.DataResponse{Frames: data.Frames{buildWideFrame(QueryOptions{SeriesLabels: labels}, res)}}
+}
+
+func evaluate(t *testing.T, expression string, responses map[string]backend.DataResponse) (string, error) {
+	t.Helper()
+	node, refs, err := parseExpression(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := backend.NewQueryDataResponse()
+	for id, r := range responses {
+		response.Responses[id] = r
+	}
+	evaluateExpressions([]expressionQuery{{qo: QueryOptions{QueryId: "E", Expression: expression}, node: node, refs: refs}}, response)
+	res := response.Responses["E"]
+	if res.Error != nil {
+		return "", res.Error
+	}
+	var got []string
+	for _, f := range res.Frames[0].Fields[1:] {
+		s := "{" + f.Labels.String() + "}"
+		for i := 0; i < f.Len(); i++ {
+			v, _ := f.NullableFloatAt(i)
+			s += fmt.Sprintf(" %v", deref(v))
+		}
+		got = append(got, s)
+	}
+	return strings.Join(got, ", "), nil
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	responses := map[string]backend.DataResponse{
+		"A": exprResponse(10, nil, "ios", "android"),
+		"B": exprResponse(2, nil, "ios"),
+		"C": exprResponse(5, data.Labels{"calculation": "AVG"}, "ios"),
+		"D": exprResponse(1, nil, "windows"),
+		"F": {Error: errors.New("boom")},
+	}
+	for expression, want := range map[string]string{
+		"(A - B) / A * 100":           "{os=ios} 80 80",
+		"A * 60":                      "{os=android} 600 1200, {os=ios} 600 1200",
+		"-B":                          "{os=ios} -2 -4",
+		"1 - B / 2":                   "{os=ios} 0 -1",
+		"C / on(os) B":                "{os=ios} 2.5 2.5",
+		"C / ignoring(calculation) B": "{os=ios} 2.5 2.5",
+		"B / ignoring(calculation) C": "{os=ios} 0.4 0.4",
+		"(C - C) / ignoring(calculation) (B - B)": "{os=ios} NaN NaN",
+	} {
+		got, err := evaluate(t, expression, responses)
+		if err != nil {
+			t.Errorf("%q: %v", expression, err)
+		} else if got != want {
+			t.Errorf("%q: got %s, want %s", expression, got, want)
+		}
+	}
+
+	var mismatch *LabelMismatchError
+	if _, err := evaluate(t, "A / D", responses); !errors.As(err, &mismatch) {
+		t.Errorf("A / D: expected a label mismatch, got %v", err)
+	}
+	if _, err := evaluate(t, "C / B", responses); !errors.As(err, &mismatch) {
+		t.Errorf("C / B: expected a label mismatch, got %v", err)
+	}
+	var duplicate *DuplicateMatchError
+	if _, err := evaluate(t, "A / on() B", responses); !errors.As(err, &duplicate) {
+		t.Errorf("A / on() B: expected a duplicate match, got %v", err)
+	}
+	var unknown *UnknownRefIDError
+	if _, err := evaluate(t, "A / X", responses); !errors.As(err, &unknown) || unknown.RefID != "X" {
+		t.Errorf("A / X: expected an unknown refID, got %v", err)
+	}
+	if _, err := evaluate(t, "A / F", responses); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("A / F: expected the error of F, got %v", err)
+	}
+	if _, err := evaluate(t, "1 + 2", responses); err == nil {
+		t.Errorf("1 + 2: expected an error for an expression without series")
+	}
+}
+
+func TestQueryDataExpression(t *testing.T) {
+	var calls atomic.Int32
+	srv := seriesServer(&calls)
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(refID string, json string) backend.DataQuery {
+		return backend.DataQuery{RefID: refID, TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)}, JSON: []byte(json)}
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{
+		query("A", `{"filterId":"f","aggregationId":1,"calculation":"COUNT"}`),
+		query("B", `{"filterId":"f","aggregationId":2,"calculation":"COUNT","hide":true}`),
+		query("C", `{"mode":"expression","expression":"B / A * 100","alias":"failure rate"}`),
+		query("D", `{"mode":"expression","expression":"C +"}`),
+		query("E", `{"mode":"expression","expression":"E * 2"}`),
+		query("F", `{"filterId":"f","mode":"variables","groupingName":"os","hide":true}`),
+		query("G", `{"mode":"expression","expression":"F * 2"}`),
+		query("H", `{"filterId":"f","aggregationId":1,"calculation":"COUNT","instant":true,"hide":true}`),
+		query("I", `{"mode":"expression","expression":"H * 2"}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := resp.Responses["C"]
+	if c.Error != nil || len(c.Frames) != 1 {
+		t.Fatalf("C: expected a frame, got %v", c)
+	}
+	var got []string
+	for _, f := range c.Frames[0].Fields[1:] {
+		v, _ := f.NullableFloatAt(0)
+		got = append(got, fmt.Sprintf("%s %s=%v", f.Name, f.Labels, deref(v)))
+	}
+	if s := strings.Join(got, ", "); s != "failure rate country=US, os=android=200, failure rate country=US, os=ios=200" {
+		t.Errorf("C: got %s", s)
+	}
+	if b := resp.Responses["B"]; b.Error != nil || len(b.Frames) != 0 {
+		t.Errorf("B: hidden queries must stay blank, got %v", b)
+	}
+	var syntaxErr *ExpressionSyntaxError
+	if err := resp.Responses["D"].Error; !errors.As(err, &syntaxErr) {
+		t.Errorf("D: expected a syntax error, got %v", err)
+	}
+	if err := resp.Responses["E"].Error; err == nil {
+		t.Errorf("E: expected an error for a self reference")
+	}
+	var unsupported *UnsupportedFormatError
+	if err := resp.Responses["G"].Error; !errors.As(err, &unsupported) || unsupported.RefID != "F" || unsupported.Format != "unknown" {
+		t.Errorf("G: expected an unsupported format naming F, got %v", err)
+	}
+	if err := resp.Responses["I"].Error; !errors.As(err, &unsupported) || unsupported.RefID != "H" || unsupported.Format != string(data.FrameTypeNumericLong) {
+		t.Errorf("I: expected an unsupported format naming H, got %v", err)
+	}
+}
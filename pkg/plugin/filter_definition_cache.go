@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// minFilterDefinitionRefresh is how old cached definitions must be before a lookup
+// of an unknown filter or aggregation refreshes them, so typos can't hammer the API.
+const minFilterDefinitionRefresh = 10 * time.Second
+
+// filterDefinitionLookupTimeout bounds how long queries wait for the definitions, a
+// slow definitions endpoint must not hold up panels.
+const filterDefinitionLookupTimeout = 2 * time.Second
+
+// maxDefinitionChanges is how many definition changes are remembered per token.
+const maxDefinitionChanges = 100
+
+type filterDefinitionEntry struct {
+	defs    []FilterDefinition
+	fetched time.Time
+}
+
+// filterDefinitionCache keeps the filter definitions of an instance for a while.
+// Entries are keyed by API token, concurrent misses share a single upstream call.
+// Entries are kept with the cache disabled too, to tell what changed between fetches.
+// The zero value is ready to use.
+type filterDefinitionCache struct {
+	mu      sync.Mutex
+	entries map[string]filterDefinitionEntry
+	changes map[string][]definitionChange
+	group   singleflight.Group
+}
+
+func (c *filterDefinitionCache) get(token string, ttl time.Duration) ([]FilterDefinition, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[token]
+	if !ok || time.Since(e.fetched) >= ttl {
+		return nil, false
+	}
+	return e.defs, true
+}
+
+func (c *filterDefinitionCache) age(token string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[token]
+	if !ok {
+		return 0
+	}
+	return time.Since(e.fetched)
+}
+
+func (c *filterDefinitionCache) set(token string, defs []FilterDefinition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]filterDefinitionEntry)
+		c.changes = make(map[string][]definitionChange)
+	}
+	now := time.Now()
+	if prev, ok := c.entries[token]; ok {
+		changes := append(c.changes[token], diffFilterDefinitions(prev.defs, defs, now)...)
+		c.changes[token] = changes[max(0, len(changes)-maxDefinitionChanges):]
+	}
+	c.entries[token] = filterDefinitionEntry{defs: defs, fetched: now}
+}
+
+// invalidate forces the next lookup to refetch. The definitions are kept to tell
+// what changed once they are fetched again.
+func (c *filterDefinitionCache) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[token]; ok {
+		c.entries[token] = filterDefinitionEntry{defs: e.defs}
+	}
+}
+
+// definitionChanges returns the changes seen in the definitions of token.
+func (c *filterDefinitionCache) definitionChanges(token string) []definitionChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.changes[token])
+}
+
+// filterDefinitions returns the filter definitions visible to token, from the cache
+// when they are fresh enough.
+func (d *handler) filterDefinitions(ctx context.Context, token string) ([]FilterDefinition, error) {
+	ttl := d.config.FilterDefinitionTTL()
+	if defs, ok := d.filterDefs.get(token, ttl); ok {
+		return defs, nil
+	}
+	return d.refreshFilterDefinitions(ctx, token)
+}
+
+// refreshFilterDefinitions fetches the definitions from the API and caches them.
+// The fetch is shared by all callers and is not cancelled when one of them gives up.
+func (d *handler) refreshFilterDefinitions(ctx context.Context, token string) ([]FilterDefinition, error) {
+	ch := d.filterDefs.group.DoChan(token, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.config.Timeout())
+		defer cancel()
+		defs, err := d.fetchFilterDefinitions(fetchCtx, token)
+		if err != nil {
+			return nil, err
+		}
+		d.filterDefs.set(token, defs)
+		return defs, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]FilterDefinition), nil
+	}
+}
+
+func findFilterDefinition(defs []FilterDefinition, filterId string) *FilterDefinition {
+	for i := range defs {
+		if defs[i].FilterId == filterId {
+			return &defs[i]
+		}
+	}
+	return nil
+}
+
+// Aggregation returns the aggregation with the given id, or nil.
+func (fd *FilterDefinition) Aggregation(id int) *FilterDefinitionAggregation {
+	for i := range fd.Aggregations {
+		if int(fd.Aggregations[i].Id) == id {
+			return &fd.Aggregations[i]
+		}
+	}
+	return nil
+}
+
+// missingAggregation reports whether the aggregation of any of qos is not in fd.
+func (fd *FilterDefinition) missingAggregation(qos []QueryOptions) bool {
+	for _, qo := range qos {
+		if fd.Aggregation(qo.AggregationId) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *handler) fetchFilterDefinitions(ctx context.Context, token string) ([]FilterDefinition, error) {
+	http_response, err := d.doRequest(ctx, "GET", "filter-definitions", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer http_response.Body.Close()
+
+	body, err := io.ReadAll(http_response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if http_response.StatusCode != 200 {
+		return nil, &apiError{Path: "filter-definitions", StatusCode: http_response.StatusCode, Status: http_response.Status, Body: body}
+	}
+
+	var filters []FilterDefinition
+	if err := json.Unmarshal(body, &filters); err != nil {
+		return nil, fmt.Errorf("Unable to deserialize response JSON")
+	}
+	return filters, nil
+}
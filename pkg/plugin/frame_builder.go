@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// valueName is the name of the value field of a query.
+func valueName(qo QueryOptions) string {
+	if qo.Alias != "" {
+		return qo.Alias
+	}
+	return qo.FilterDefinitionName
+}
+
+// groupingNames returns the column and label names of groupings, their aliases when
+// the query asks for them. A grouping keeps its key when its alias is taken already.
+func groupingNames(qo QueryOptions, groupings []string) []string {
+	names := slices.Clone(groupings)
+	if !qo.UseGroupingAliases {
+		return names
+	}
+	for k, g := range groupings {
+		alias, ok := qo.GroupingAliases[g]
+		if ok && !slices.Contains(names, alias) {
+			names[k] = alias
+		}
+	}
+	return names
+}
+
+// buildLongFrame turns the points of a query into a long frame with a time column,
+// a string column per grouping and the value column. data.NewField copies the columns,
+// the result can stay shared through the caches.
+func buildLongFrame(qo QueryOptions, res *queryResult) *data.Frame {
+	fields := make(data.Fields, 0, 2+len(res.Groupings))
+	fields = append(fields, data.NewField("time", nil, res.Times))
+	for k, g := range groupingNames(qo, res.Groupings) {
+		fields = append(fields, data.NewField(g, nil, res.GroupingValues[k]))
+	}
+	fields = append(fields, data.NewField(valueName(qo), maps.Clone(qo.SeriesLabels), res.Values))
+
+	frame := data.NewFrame("Long", fields...)
+	frame.Meta = &data.FrameMeta{}
+	return frame
+}
+
+// buildWideFrame turns the points of a query into a wide frame with a time column and
+// a nullable value column per combination of grouping values, labelled with them.
+// It matches data.LongToWide on the long frame with missing values filled with null:
+// value columns are ordered by their grouping values, in the order of the groupings,
+// and the last point wins when a series has several at the same time.
+func buildWideFrame(qo QueryOptions, res *queryResult) *data.Frame {
+	times := make([]time.Time, 0, len(res.Times))
+	rows := make([]int, len(res.Times))
+	for i, t := range res.Times {
+		if len(times) == 0 || t.After(times[len(times)-1]) {
+			times = append(times, t)
+		}
+		rows[i] = len(times) - 1
+	}
+
+	type series struct {
+		labels []string
+		values []*float64
+	}
+	var all []*series
+	index := make(map[string]*series)
+	key := make([]string, len(res.Groupings))
+	for i := range res.Times {
+		for k := range res.Groupings {
+			key[k] = res.GroupingValues[k][i]
+		}
+		id := strings.Join(key, "\x00")
+		s, ok := index[id]
+		if !ok {
+			s = &series{labels: slices.Clone(key), values: make([]*float64, len(times))}
+			index[id] = s
+			all = append(all, s)
+		}
+		v := res.Values[i]
+		s.values[rows[i]] = &v
+	}
+	slices.SortStableFunc(all, func(a, b *series) int {
+		return slices.Compare(a.labels, b.labels)
+	})
+
+	name := valueName(qo)
+	label_names := groupingNames(qo, res.Groupings)
+	fields := make(data.Fields, 0, 1+len(all))
+	fields = append(fields, data.NewField("time", nil, times))
+	for _, s := range all {
+		labels := make(data.Labels, len(res.Groupings)+len(qo.SeriesLabels))
+		for k, g := range label_names {
+			labels[g] = s.labels[k]
+		}
+		for k, v := range qo.SeriesLabels {
+			labels[k] = v
+		}
+		fields = append(fields, data.NewField(name, labels, s.values))
+	}
+
+	frame := data.NewFrame("Long", fields...)
+	frame.Meta = &data.FrameMeta{
+		Type:        data.FrameTypeTimeSeriesWide,
+		TypeVersion: data.FrameTypeVersion{0, 1},
+	}
+	return frame
+}
+
+// Output formats of a query besides the default wide or long frames.
+const (
+	// formatMulti returns a TimeSeriesMulti frame per series, labelled with its groupings.
+	formatMulti = "multi"
+	// formatNumeric returns a NumericMulti frame per series, holding its reduced value.
+	formatNumeric = "numeric"
+)
+
+// Reducers turning the points of a series into a single number.
+const (
+	reduceLast = "last"
+	reduceSum  = "sum"
+	reduceAvg  = "avg"
+	reduceMax  = "max"
+	reduceMin  = "min"
+)
+
+// validReducer reports whether r is a known reducer, empty meaning last.
+func validReducer(r string) bool {
+	switch r {
+	case "", reduceLast, reduceSum, reduceAvg, reduceMax, reduceMin:
+		return true
+	}
+	return false
+}
+
+// reduce reduces the values of a series, in time order, to a single number.
+func reduce(reducer string, values []float64) float64 {
+	switch reducer {
+	case reduceSum, reduceAvg:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		if reducer == reduceAvg {
+			return sum / float64(len(values))
+		}
+		return sum
+	case reduceMax:
+		return slices.Max(values)
+	case reduceMin:
+		return slices.Min(values)
+	default:
+		return values[len(values)-1]
+	}
+}
+
+// resultSeries is a series of a result, the points sharing the same grouping values.
+type resultSeries struct {
+	values []string
+	labels data.Labels
+	points []int
+}
+
+// splitSeries splits the points of res by their grouping values, ordered like the value
+// fields of a wide frame. Labels use the grouping names of the query and its series
+// labels.
+func splitSeries(qo QueryOptions, res *queryResult) []*resultSeries {
+	var all []*resultSeries
+	index := make(map[string]*resultSeries)
+	key := make([]string, len(res.Groupings))
+	for i := range res.Times {
+		for k := range res.Groupings {
+			key[k] = res.GroupingValues[k][i]
+		}
+		id := strings.Join(key, "\x00")
+		s, ok := index[id]
+		if !ok {
+			s = &resultSeries{values: slices.Clone(key)}
+			index[id] = s
+			all = append(all, s)
+		}
+		s.points = append(s.points, i)
+	}
+	slices.SortStableFunc(all, func(a, b *resultSeries) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	names := groupingNames(qo, res.Groupings)
+	for _, s := range all {
+		if len(names)+len(qo.SeriesLabels) == 0 {
+			continue
+		}
+		s.labels = make(data.Labels, len(names)+len(qo.SeriesLabels))
+		for k, g := range names {
+			s.labels[g] = s.values[k]
+		}
+		for k, v := range qo.SeriesLabels {
+			s.labels[k] = v
+		}
+	}
+	return all
+}
+
+// buildMultiFrames returns a TimeSeriesMulti frame per series of res. When a series has
+// several points at the same time the last one wins, as in wide frames.
+func buildMultiFrames(qo QueryOptions, res *queryResult) data.Frames {
+	var frames data.Frames
+	for _, s := range splitSeries(qo, res) {
+		times := make([]time.Time, 0, len(s.points))
+		values := make([]float64, 0, len(s.points))
+		for _, i := range s.points {
+			if n := len(times); n > 0 && times[n-1].Equal(res.Times[i]) {
+				values[n-1] = res.Values[i]
+				continue
+			}
+			times = append(times, res.Times[i])
+			values = append(values, res.Values[i])
+		}
+		frame := data.NewFrame(valueName(qo),
+			data.NewField("time", nil, times),
+			data.NewField(valueName(qo), s.labels, values),
+		)
+		frame.Meta = &data.FrameMeta{
+			Type:        data.FrameTypeTimeSeriesMulti,
+			TypeVersion: data.FrameTypeVersion{0, 1},
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// buildNumericFrames returns a NumericMulti frame per series of res, holding the value
+// of the series reduced with the reducer of the query.
+func buildNumericFrames(qo QueryOptions, res *queryResult) data.Frames {
+	var frames data.Frames
+	for _, s := range splitSeries(qo, res) {
+		values := make([]float64, len(s.points))
+		for j, i := range s.points {
+			values[j] = res.Values[i]
+		}
+		frame := data.NewFrame(valueName(qo),
+			data.NewField(valueName(qo), s.labels, []float64{reduce(qo.Reducer, values)}),
+		)
+		frame.Meta = &data.FrameMeta{
+			Type:        data.FrameTypeNumericMulti,
+			TypeVersion: data.FrameTypeVersion{0, 1},
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// buildNumericTable returns a NumericLong frame with a row per series of res, keyed by
+// the grouping columns, holding the value of the series reduced with the reducer of
+// the query. Ranges aggregated by the API may still span several intervals, without a
+// reducer they are combined according to the calculation, see instantReducer.
+func buildNumericTable(qo QueryOptions, res *queryResult) (*data.Frame, error) {
+	reducer := qo.Reducer
+	if reducer == "" {
+		reducer = instantReducer(qo)
+	}
+	all := splitSeries(qo, res)
+	names := groupingNames(qo, res.Groupings)
+	fields := make(data.Fields, 0, len(names)+1)
+	for k, g := range names {
+		col := make([]string, len(all))
+		for i, s := range all {
+			col[i] = s.values[k]
+		}
+		fields = append(fields, data.NewField(g, nil, col))
+	}
+	values := make([]float64, len(all))
+	for i, s := range all {
+		if reducer == "" && len(s.points) > 1 {
+			return nil, fmt.Errorf("the range of %s spans %d intervals, %s values can't be combined without a reducer", valueName(qo), len(s.points), qo.Calculation)
+		}
+		points := make([]float64, len(s.points))
+		for j, p := range s.points {
+			points[j] = res.Values[p]
+		}
+		values[i] = reduce(reducer, points)
+	}
+	fields = append(fields, data.NewField(valueName(qo), maps.Clone(qo.SeriesLabels), values))
+
+	frame := data.NewFrame(valueName(qo), fields...)
+	frame.Meta = &data.FrameMeta{
+		Type:        data.FrameTypeNumericLong,
+		TypeVersion: data.FrameTypeVersion{0, 1},
+	}
+	return frame, nil
+}
+
+// instantReducer returns the reducer combining the intervals of an instant query
+// without one, empty when its calculation, or a ratio, can't be combined.
+func instantReducer(qo QueryOptions) string {
+	if qo.Mode == ratioMode {
+		return ""
+	}
+	switch qo.Calculation {
+	case COUNT, SUM:
+		return reduceSum
+	case MAX:
+		return reduceMax
+	case MIN:
+		return reduceMin
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// referenceFrames builds the frames of res through the SDK, row by row, as the plugin
+// used to.
+func referenceFrames(t *testing.T, qo QueryOptions, res *queryResult) (*data.Frame, *data.Frame) {
+	t.Helper()
+	fields := data.Fields{data.NewField("time", nil, []time.Time{})}
+	for _, g := range res.Groupings {
+		fields = append(fields, data.NewField(g, nil, []string{}))
+	}
+	fields = append(fields, data.NewField(valueName(qo), nil, []float64{}))
+	long := data.NewFrame("Long", fields...)
+	long.Meta = &data.FrameMeta{}
+	for i := range res.Times {
+		row := []interface{}{res.Times[i]}
+		for k := range res.Groupings {
+			row = append(row, res.GroupingValues[k][i])
+		}
+		long.AppendRow(append(row, res.Values[i])...)
+	}
+	// LongToWide reuses the meta of the long frame, only the wide path converted
+	converted := *long
+	converted.Meta = &data.FrameMeta{}
+	wide, err := data.LongToWide(&converted, &data.FillMissing{Mode: data.FillModeNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return long, wide
+}
+
+func TestBuildFramesMatchesSDK(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	res := &queryResult{
+		HasData:   true,
+		Groupings: []string{"os", "country"},
+		Times:     []time.Time{start, start, start, start.Add(time.Minute), start.Add(time.Minute), start.Add(2 * time.Minute)},
+		Values:    []float64{1, 3, 4, 2, 5, 6},
+		GroupingValues: [][]string{
+			{"ios", "android", "ios", "ios", "", "android"},
+			{"US", "US", "US", "FR", "FR", "US"},
+		},
+	}
+	qo := QueryOptions{FilterDefinitionName: "Logins"}
+
+	long, wide := referenceFrames(t, qo, res)
+	for _, c := range []struct {
+		name      string
+		got, want *data.Frame
+	}{
+		{"long", buildLongFrame(qo, res), long},
+		{"wide", buildWideFrame(qo, res), wide},
+	} {
+		got, err := json.Marshal(c.got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.Marshal(c.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s frame:\n got %s\nwant %s", c.name, got, want)
+		}
+	}
+}
+
+func TestBuildMultiFrames(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	res := &queryResult{
+		HasData:        true,
+		Groupings:      []string{"os"},
+		Times:          []time.Time{start, start, start.Add(time.Minute), start.Add(time.Minute), start.Add(2 * time.Minute)},
+		Values:         []float64{1, 3, 4, 5, 6},
+		GroupingValues: [][]string{{"ios", "android", "ios", "ios", "android"}},
+	}
+	qo := QueryOptions{FilterDefinitionName: "Logins", SeriesLabels: data.Labels{"calculation": "COUNT"}}
+
+	frames := buildMultiFrames(qo, res)
+	if len(frames) != 2 {
+		t.Fatalf("expected a frame per os, got %d", len(frames))
+	}
+	for i, want := range []struct {
+		os     string
+		times  int
+		values []float64
+	}{{"android", 2, []float64{3, 6}}, {"ios", 2, []float64{1, 5}}} {
+		f := frames[i]
+		if f.Meta.Type != data.FrameTypeTimeSeriesMulti || f.Rows() != want.times {
+			t.Errorf("%s: unexpected frame %v", want.os, frameTable(f))
+			continue
+		}
+		value := f.Fields[1]
+		if value.Labels["os"] != want.os || value.Labels["calculation"] != "COUNT" {
+			t.Errorf("%s: got labels %v", want.os, value.Labels)
+		}
+		for r, v := range want.values {
+			if value.At(r).(float64) != v {
+				t.Errorf("%s: row %d is %v, want %v", want.os, r, value.At(r), v)
+			}
+		}
+	}
+
+	for reducer, want := range map[string][]float64{
+		"":        {6, 5},
+		reduceSum: {9, 10},
+		reduceAvg: {4.5, 10.0 / 3},
+		reduceMax: {6, 5},
+		reduceMin: {3, 1},
+	} {
+		qo.Reducer = reducer
+		frames := buildNumericFrames(qo, res)
+		if len(frames) != 2 || frames[0].Meta.Type != data.FrameTypeNumericMulti {
+			t.Fatalf("%q: expected a numeric frame per os, got %v", reducer, frames)
+		}
+		for i, f := range frames {
+			if f.Rows() != 1 || f.Fields[0].At(0).(float64) != want[i] {
+				t.Errorf("%q: frame %d is %v, want %v", reducer, i, frameTable(f), want[i])
+			}
+		}
+	}
+}
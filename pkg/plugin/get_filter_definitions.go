@@ -2,7 +2,7 @@ package handler
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
 	"net/http"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
@@ -10,64 +10,50 @@ import (
 
 func (d *handler) GetFilterDefinitions(rw http.ResponseWriter, req *http.Request) {
 	pluginCtx := httpadapter.PluginConfigFromContext(req.Context())
-	api_token := pluginCtx.DataSourceInstanceSettings.DecryptedSecureJSONData["apiKey"]
-	client := d.httpClient
+	api_token := apiToken(pluginCtx)
 
-	request, err := http.NewRequest("GET", url_base+"filter-definitions", nil)
-	if err != nil {
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
+	var filters []FilterDefinition
+	var err error
+	if req.URL.Query().Get("refresh") == "true" {
+		filters, err = d.refreshFilterDefinitions(req.Context(), api_token)
+	} else {
+		filters, err = d.filterDefinitions(req.Context(), api_token)
 	}
-	request.Header.Set("x-api-token", api_token)
-	request.Header.Set("Content-Type", "application/json")
-	http_response, err := client.Do(request)
 	if err != nil {
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
-	}
-	defer http_response.Body.Close()
-	if http_response.StatusCode != 200 {
-		body, err := io.ReadAll(http_response.Body)
-		if err != nil {
-			rw.WriteHeader(500)
-			rw.Write([]byte(err.Error()))
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			rw.WriteHeader(apiErr.StatusCode)
+			rw.Write(apiErr.Body)
 			return
 		}
-		rw.WriteHeader(http_response.StatusCode)
-		rw.Write(body)
-		return
-	}
-
-	body, err := io.ReadAll(http_response.Body)
-	if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	var filters []FilterDefinition
-	if err := json.Unmarshal(body, &filters); err != nil {
-		if err != nil {
-			//backend.Logger.Warn(string(body))
-			//backend.Logger.Warn(err.Error())
-			rw.WriteHeader(500)
-			rw.Write([]byte("Unable to deserialize response JSON"))
-			return
-		}
-	}
+
 	bytes, err := json.Marshal(filters)
 	if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
+	rw.Header().Set("Content-Type", "application/json")
 	_, err = rw.Write(bytes)
 	if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	rw.WriteHeader(http.StatusOK)
+}
 
+// InvalidateFilterDefinitions drops the cached filter definitions, so the next
+// request fetches them from the API again.
+func (d *handler) InvalidateFilterDefinitions(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pluginCtx := httpadapter.PluginConfigFromContext(req.Context())
+	d.filterDefs.invalidate(apiToken(pluginCtx))
+	rw.WriteHeader(http.StatusNoContent)
 }
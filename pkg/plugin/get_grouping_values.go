@@ -1,38 +1,24 @@
 package handler
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"net/http"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
-func (d *handler) queryGroupings(_ context.Context, password string, Ctx backend.PluginContext, query backend.DataQuery, qo QueryOptions) backend.DataResponse {
+func (d *handler) queryGroupings(ctx context.Context, password string, Ctx backend.PluginContext, query backend.DataQuery, qo QueryOptions) backend.DataResponse {
 	var response backend.DataResponse
 
-	client := d.httpClient
-
-	payloadbytes, err := json.Marshal(qo)
-	if err != nil {
-		response.Error = err
-		return response
-	}
-
-	request, err := http.NewRequest("POST", url_base+"metrics/groupings", bytes.NewBuffer(payloadbytes))
-
+	payloadbytes, err := json.Marshal(qo.upstream())
 	if err != nil {
 		response.Error = err
 		return response
 	}
-	request.Header.Set("x-api-token", password)
-	request.Header.Set("Content-Type", "application/json")
 
-	http_response, err := client.Do(request)
+	http_response, err := d.doRequest(ctx, "POST", "metrics/groupings", password, payloadbytes)
 	if err != nil {
 		response.Error = err
 		return response
@@ -46,7 +32,7 @@ func (d *handler) queryGroupings(_ context.Context, password string, Ctx backend
 			return response
 		}
 		//backend.Logger.Warn(http_response.Status)
-		response.Error = fmt.Errorf("Error fetching results %d / %q", http_response.StatusCode, string(body))
+		response.Error = &apiError{Path: "metrics/groupings", StatusCode: http_response.StatusCode, Status: http_response.Status, Body: body}
 		return response
 	}
 
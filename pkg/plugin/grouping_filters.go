@@ -0,0 +1,68 @@
+package handler
+
+import "slices"
+
+// aggregateAllFilter is the grouping filter value asking the API to aggregate all values
+// of a grouping together.
+const aggregateAllFilter = "$__agg"
+
+// GroupingFilterMappingItem is how the query editor maps a grouping to its filter: the
+// aggregate all option, a dashboard variable by id, or manual values.
+type GroupingFilterMappingItem struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	ManualValues *[]string `json:"manual_values"`
+}
+
+// resolveGroupingFilters builds the grouping filters of qo from the mapping of the query
+// editor, like applyTemplateVariables in the frontend does, so queries that don't go
+// through the frontend such as alert rules get the same filters. Dashboard variables
+// are only known to the frontend, a grouping mapped to one keeps the values the
+// frontend interpolated into GroupingFilters, or none. The mapping is dropped afterwards,
+// it is not part of the query sent to the API.
+func (qo *QueryOptions) resolveGroupingFilters() {
+	if qo.GroupingFilterMapping == nil {
+		return
+	}
+	interpolated := make(map[string]*[]string)
+	if qo.GroupingFilters != nil {
+		for _, gf := range *qo.GroupingFilters {
+			interpolated[gf.Grouping] = gf.Filters
+		}
+	}
+
+	var items []GroupingOrFilterItem
+	hasany := false
+	groupings := make([]string, 0, len(qo.GroupingFilterMapping))
+	for k := range qo.GroupingFilterMapping {
+		groupings = append(groupings, k)
+	}
+	slices.Sort(groupings)
+	for _, k := range groupings {
+		val := qo.GroupingFilterMapping[k]
+		fi := GroupingOrFilterItem{Grouping: k, ReturnGroupingValues: true}
+		if include, ok := qo.GroupingFilterIncludes[k]; ok {
+			fi.ReturnGroupingValues = include
+		}
+		if val.Id == aggregateAllFilter {
+			fi.Filters = &[]string{aggregateAllFilter}
+			fi.ReturnGroupingValues = false
+			hasany = true
+		} else if val.ManualValues != nil {
+			filters := slices.Clone(*val.ManualValues)
+			fi.Filters = &filters
+			hasany = true
+		} else if filters := interpolated[k]; filters != nil {
+			fi.Filters = filters
+			hasany = true
+		}
+		items = append(items, fi)
+	}
+
+	qo.GroupingFilters = nil
+	if hasany {
+		qo.GroupingFilters = &items
+	}
+	qo.GroupingFilterMapping = nil
+	qo.GroupingFilterIncludes = nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestResolveGroupingFilters(t *testing.T) {
+	for name, c := range map[string]struct {
+		query string
+		want  string
+	}{
+		"manual values": {
+			query: `{"grouping_filter_mapping":{"os":{"id":"m","name":"m","manual_values":["ios","android"]}}}`,
+			want:  `[{"grouping":"os","filters":["ios","android"],"returnGroupingValues":true}]`,
+		},
+		"aggregate all": {
+			query: `{"grouping_filter_mapping":{"os":{"id":"$__agg","name":"$__agg"}},"grouping_filter_includes":{"os":true}}`,
+			want:  `[{"grouping":"os","filters":["$__agg"],"returnGroupingValues":false}]`,
+		},
+		"excluded grouping": {
+			query: `{"grouping_filter_mapping":{"os":{"id":"m","name":"m","manual_values":[]}},"grouping_filter_includes":{"os":false}}`,
+			want:  `[{"grouping":"os","filters":[],"returnGroupingValues":false}]`,
+		},
+		"interpolated variable": {
+			query: `{"grouping_filter_mapping":{"os":{"id":"v","name":"os"},"country":{"id":"m","name":"m","manual_values":["US"]}},` +
+				`"groupingFilters":[{"grouping":"os","filters":["ios"],"returnGroupingValues":true},{"grouping":"country","filters":["FR"]}]}`,
+			want: `[{"grouping":"country","filters":["US"],"returnGroupingValues":true},{"grouping":"os","filters":["ios"],"returnGroupingValues":true}]`,
+		},
+		"unknown variable only": {
+			query: `{"grouping_filter_mapping":{"os":{"id":"v","name":"os"}}}`,
+			want:  `null`,
+		},
+		"no mapping": {
+			query: `{"groupingFilters":[{"grouping":"os","filters":["ios"],"returnGroupingValues":true}]}`,
+			want:  `[{"grouping":"os","filters":["ios"],"returnGroupingValues":true}]`,
+		},
+	} {
+		var qo QueryOptions
+		if err := json.Unmarshal([]byte(c.query), &qo); err != nil {
+			t.Fatal(err)
+		}
+		qo.resolveGroupingFilters()
+		got, _ := json.Marshal(qo.GroupingFilters)
+		if string(got) != c.want {
+			t.Errorf("%s: got %s, want %s", name, got, c.want)
+		}
+		if qo.GroupingFilterMapping != nil || qo.GroupingFilterIncludes != nil {
+			t.Errorf("%s: the mapping must not be sent to the API", name)
+		}
+	}
+}
+
+func TestQueryDataResolvesGroupingFilters(t *testing.T) {
+	payloads := make(chan string, 1)
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payloads <- string(body)
+		w.Write([]byte("[]"))
+	})
+	defer srv.Close()
+
+	// alert rules send the query as saved by the editor, without the frontend's interpolation
+	_, err := newTestHandler(t, srv.URL).QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"filterId":"f","aggregationId":1,"calculation":"COUNT","grouping_filter_mapping":{"os":{"id":"m","name":"m","manual_values":["ios"]}}}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := <-payloads
+	if !strings.Contains(payload, `"groupingFilters":[{"grouping":"os","filters":["ios"],"returnGroupingValues":true}]`) {
+		t.Errorf("expected the manual filter in the payload, got %s", payload)
+	}
+	if strings.Contains(payload, "grouping_filter_mapping") {
+		t.Errorf("the mapping must not be sent, got %s", payload)
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// Rolling dashboards ask for almost the same range on every refresh. The series of
+// such queries are kept regardless of their range, so a refresh only needs to fetch
+// the tail after the last interval we have, which is re-fetched since it may have
+// been incomplete. The tail is then merged into the kept series.
+
+// incrementalQuery returns the kept series of qo and the query for the missing tail,
+// ok is false when qo has to be fetched in full.
+func (d *handler) incrementalQuery(token string, qo QueryOptions) (base *queryResult, tail QueryOptions, ok bool) {
+	if d.config.IncrementalTTL() <= 0 || qo.LimitN != nil || qo.RecalculatedInterval != nil {
+		// the top N groupings and recalculated intervals depend on the whole range
+		return nil, qo, false
+	}
+	base, ok = d.series.get(seriesCacheKey(token, qo))
+	if !ok || len(base.Times) == 0 {
+		return nil, qo, false
+	}
+	from, err := time.Parse(time.RFC3339, qo.StartTime)
+	if err != nil {
+		return nil, qo, false
+	}
+	to, err := time.Parse(time.RFC3339, qo.EndTime)
+	if err != nil {
+		return nil, qo, false
+	}
+	tailStart := base.Times[len(base.Times)-1]
+	if from.Before(base.From) || to.Before(base.To) || !tailStart.After(from) {
+		return nil, qo, false
+	}
+	tail = qo
+	tail.StartTime = tailStart.UTC().Format(time.RFC3339)
+	return base, tail, true
+}
+
+// mergeTail keeps the points of base within [from, start of tail) and appends the
+// points of the freshly fetched tail, the groupings of both in the order of the filter
+// definition like a fetch of the whole range would have them.
+func mergeTail(base *queryResult, tail *queryResult, from time.Time, tailStart time.Time, order []string) *queryResult {
+	groupings := make(map[string]string, len(base.Groupings)+len(tail.Groupings))
+	for _, k := range slices.Concat(base.Groupings, tail.Groupings) {
+		groupings[k] = ""
+	}
+	merged := &queryResult{
+		Groupings: orderGroupings(groupings, order),
+		From:      from,
+		To:        tail.To,
+	}
+
+	first := sort.Search(len(base.Times), func(i int) bool { return !base.Times[i].Before(from) })
+	last := sort.Search(len(base.Times), func(i int) bool { return !base.Times[i].Before(tailStart) })
+	tailFirst := sort.Search(len(tail.Times), func(i int) bool { return !tail.Times[i].Before(tailStart) })
+
+	size := last - first + len(tail.Times) - tailFirst
+	merged.Times = make([]time.Time, 0, size)
+	merged.Times = append(append(merged.Times, base.Times[first:last]...), tail.Times[tailFirst:]...)
+	merged.Values = make([]float64, 0, size)
+	merged.Values = append(append(merged.Values, base.Values[first:last]...), tail.Values[tailFirst:]...)
+	merged.GroupingValues = make([][]string, len(merged.Groupings))
+	for k, g := range merged.Groupings {
+		col := make([]string, 0, size)
+		col = append(col, groupingColumn(base, g, first, last)...)
+		merged.GroupingValues[k] = append(col, groupingColumn(tail, g, tailFirst, len(tail.Times))...)
+	}
+	merged.HasData = len(merged.Times) > 0
+	return merged
+}
+
+// groupingColumn returns the values of grouping g for the points [from, to) of res,
+// empty strings when res doesn't have the grouping.
+func groupingColumn(res *queryResult, g string, from int, to int) []string {
+	if k := slices.Index(res.Groupings, g); k >= 0 {
+		return res.GroupingValues[k][from:to]
+	}
+	return make([]string, to-from)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// A legend template names the series of a query, like the legend format of Prometheus:
+// "{{os}} / {{country}} ({{__calc}})". Placeholders name a grouping, by key or alias, or
+// one of the builtins below. A placeholder may give a fallback for series without the
+// label, "{{os|unknown}}", and "\{{" writes literal braces.
+const (
+	legendAlias       = "__alias"
+	legendName        = "__name"
+	legendFilter      = "__filter"
+	legendAggregation = "__aggregation"
+	legendCalculation = "__calc"
+	legendPercentile  = "__percentile"
+)
+
+type legendPart struct {
+	text     string
+	label    string
+	fallback string
+}
+
+// legendTemplate is a parsed legend format, text parts have an empty label.
+type legendTemplate []legendPart
+
+// parseLegend parses format, an unterminated placeholder is kept as text.
+func parseLegend(format string) legendTemplate {
+	var t legendTemplate
+	var text strings.Builder
+	for i := 0; i < len(format); i++ {
+		switch {
+		case format[i] == '\\' && i+1 < len(format) && (format[i+1] == '{' || format[i+1] == '\\'):
+			i++
+			text.WriteByte(format[i])
+			if format[i] == '{' && i+1 < len(format) && format[i+1] == '{' {
+				i++
+				text.WriteByte('{')
+			}
+		case strings.HasPrefix(format[i:], "{{"):
+			end := strings.Index(format[i+2:], "}}")
+			if end < 0 {
+				text.WriteString(format[i:])
+				i = len(format)
+				continue
+			}
+			if text.Len() > 0 {
+				t = append(t, legendPart{text: text.String()})
+				text.Reset()
+			}
+			label, fallback, _ := strings.Cut(format[i+2:i+2+end], "|")
+			t = append(t, legendPart{label: strings.TrimSpace(label), fallback: strings.TrimSpace(fallback)})
+			i += end + 3
+		default:
+			text.WriteByte(format[i])
+		}
+	}
+	if text.Len() > 0 {
+		t = append(t, legendPart{text: text.String()})
+	}
+	return t
+}
+
+// render names the series of qo with labels. It returns an empty string when no
+// placeholder had a value, so the caller can fall back to the default name.
+func (t legendTemplate) render(qo QueryOptions, labels data.Labels) string {
+	var sb strings.Builder
+	placeholders, resolved := 0, 0
+	for _, p := range t {
+		if p.label == "" {
+			sb.WriteString(p.text)
+			continue
+		}
+		placeholders++
+		v, ok := legendValue(qo, labels, p.label)
+		if !ok || v == "" {
+			v = p.fallback
+		}
+		if v != "" {
+			resolved++
+		}
+		sb.WriteString(v)
+	}
+	if placeholders > 0 && resolved == 0 || strings.TrimSpace(sb.String()) == "" {
+		return ""
+	}
+	return sb.String()
+}
+
+// legendValue looks up a placeholder of the legend template.
+func legendValue(qo QueryOptions, labels data.Labels, label string) (string, bool) {
+	switch label {
+	case legendAlias:
+		return qo.Alias, true
+	case legendName:
+		return valueName(qo), true
+	case legendFilter:
+		return qo.FilterDefinitionName, true
+	case legendAggregation:
+		return qo.AggregationName, true
+	case legendCalculation:
+		return string(qo.Calculation), true
+	case legendPercentile:
+		if qo.Calculation != PERCENTILES || !qo.Percentile.Valid {
+			return "", false
+		}
+		return strconv.FormatFloat(qo.Percentile.Float64, 'f', -1, 64), true
+	}
+	if v, ok := labels[label]; ok {
+		return v, true
+	}
+	// a grouping may be named by its key while its label carries the alias, or the other way round
+	for g, alias := range qo.GroupingAliases {
+		if g == label {
+			if v, ok := labels[alias]; ok {
+				return v, true
+			}
+		} else if alias == label {
+			if v, ok := labels[g]; ok {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+func TestLegendTemplate(t *testing.T) {
+	qo := QueryOptions{
+		Alias:                "logins",
+		FilterDefinitionName: "Logins",
+		AggregationName:      "All",
+		Calculation:          PERCENTILES,
+		Percentile:           null.FloatFrom(0.95),
+		GroupingAliases:      map[string]string{"os": "OS"},
+	}
+	labels := data.Labels{"os": "ios", "country": "US", "city": ""}
+	for _, c := range []struct {
+		format string
+		want   string
+	}{
+		{"{{os}} / {{country}} ({{__calc}})", "ios / US (PERCENTILES)"},
+		{"{{ os }} p{{__percentile}}", "ios p0.95"},
+		{"{{__filter}} {{__aggregation}} {{__alias}} {{__name}}", "Logins All logins logins"},
+		{"{{OS}}", "ios"},
+		{"{{city|unknown}} {{region|n/a}}", "unknown n/a"},
+		{"{{region}}-{{os}}", "-ios"},
+		{"{{region}}", ""},
+		{"{{city}} {{region}}", ""},
+		{"Logins", "Logins"},
+		{`\{{os}} {{os}}`, "{{os}} ios"},
+		{`C:\\{{os}}`, `C:\ios`},
+		{`a\b`, `a\b`},
+		{"{{os", "{{os"},
+		{"", ""},
+	} {
+		if got := parseLegend(c.format).render(qo, labels); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.format, got, c.want)
+		}
+	}
+
+	qo.Calculation = COUNT
+	if got := parseLegend("{{__percentile|-}}").render(qo, labels); got != "-" {
+		t.Errorf("percentile of COUNT: got %q", got)
+	}
+	qo.UseGroupingAliases = true
+	if got := parseLegend("{{os}}").render(qo, data.Labels{"OS": "ios"}); got != "ios" {
+		t.Errorf("grouping by key with aliased labels: got %q", got)
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// decodeMetricResults reads the separator/value stream of metrics/results straight into
+// the columns of each query's result, without holding the body or the decoded rows in
+// memory. A separator carries the start time and the groupings of the values following
+// it, a value carries its offset in seconds from that start.
+func decodeMetricResults(r io.Reader, qos []QueryOptions) (map[string]*queryResult, error) {
+	results := make(map[string]*queryResult)
+	orders := make(map[string][]string)
+	for q := range qos {
+		orders[qos[q].QueryId] = qos[q].GroupingOrder
+		res := &queryResult{}
+		res.From, _ = time.Parse(time.RFC3339, qos[q].StartTime)
+		res.To, _ = time.Parse(time.RFC3339, qos[q].EndTime)
+		results[qos[q].QueryId] = res
+	}
+	var single_q = len(qos) == 1
+
+	iter := jsoniter.Parse(metricsJSON, r, 64*1024)
+	if iter.WhatIsNext() == jsoniter.NilValue {
+		iter.ReadNil()
+		return results, iter.Error
+	}
+
+	current_dt_start := time.Unix(0, 0)
+	current_groupings := map[string]string{}
+	var mr metricRow
+	for iter.ReadArray() {
+		if err := mr.read(iter); err != nil {
+			return nil, err
+		}
+		if mr.IsSeperator != nil && *mr.IsSeperator {
+			current_dt_start = mr.dt
+			current_groupings = mr.Groupings
+			continue
+		}
+		queryId := mr.QueryId
+		if mr.IsSeperator == nil && single_q {
+			queryId = qos[0].QueryId
+		}
+		res, ok := results[queryId]
+		if !ok {
+			continue
+		}
+		if !res.HasData && current_dt_start != time.Unix(0, 0) {
+			res.HasData = true
+			res.Groupings = orderGroupings(current_groupings, orders[queryId])
+			res.GroupingValues = make([][]string, len(res.Groupings))
+		}
+		res.Times = append(res.Times, current_dt_start.Add(time.Second*time.Duration(mr.DtSecLater)))
+		res.Values = append(res.Values, mr.Val)
+		for k, g := range res.Groupings {
+			res.GroupingValues[k] = append(res.GroupingValues[k], current_groupings[g])
+		}
+	}
+	if iter.Error != nil {
+		return nil, iter.Error
+	}
+
+	for _, res := range results {
+		sort.Stable(byTime{res})
+	}
+	return results, nil
+}
+
+// orderGroupings returns the keys of groupings in the order of the filter definition,
+// keys it doesn't know come last in alphabetical order.
+func orderGroupings(groupings map[string]string, order []string) []string {
+	keys := make([]string, 0, len(groupings))
+	for _, k := range order {
+		if _, ok := groupings[k]; ok && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	known := len(keys)
+	for k := range groupings {
+		if !slices.Contains(keys[:known], k) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys[known:])
+	return keys
+}
+
+// metricsJSON decodes the metrics/results stream. Its field names are plain ASCII, they
+// are matched in place rather than copied.
+var metricsJSON = jsoniter.Config{CaseSensitive: true, ObjectFieldMustBeSimpleString: true}.Froze()
+
+// metricRow is a single element of the metrics/results stream, see MetricResult.
+type metricRow struct {
+	IsSeperator *bool             `json:"isSeperator"`
+	Dt          string            `json:"dt"`
+	DtSecLater  int64             `json:"dtSecLater"`
+	Val         float64           `json:"val"`
+	Groupings   map[string]string `json:"groupings"`
+	QueryId     string            `json:"queryId"`
+
+	dt time.Time
+}
+
+// read decodes the next object of the stream into mr. Field names are matched in
+// place, values only allocate query ids longer than a byte, separators their groupings.
+func (mr *metricRow) read(iter *jsoniter.Iterator) error {
+	*mr = metricRow{}
+	iter.ReadVal(mr)
+	if iter.Error != nil {
+		return iter.Error
+	}
+	if mr.Dt != "" {
+		dt, err := time.Parse(time.RFC3339Nano, mr.Dt)
+		if err != nil {
+			return fmt.Errorf("metrics/results: %w", err)
+		}
+		mr.dt = dt
+	}
+	return nil
+}
+
+// byTime sorts the points of a result by time, moving all columns together.
+type byTime struct{ *queryResult }
+
+func (b byTime) Len() int           { return len(b.Times) }
+func (b byTime) Less(i, j int) bool { return b.Times[i].Before(b.Times[j]) }
+func (b byTime) Swap(i, j int) {
+	b.Times[i], b.Times[j] = b.Times[j], b.Times[i]
+	b.Values[i], b.Values[j] = b.Values[j], b.Values[i]
+	for _, col := range b.GroupingValues {
+		col[i], col[j] = col[j], col[i]
+	}
+}
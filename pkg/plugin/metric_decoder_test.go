@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestDecodeMetricResults(t *testing.T) {
+	results, err := decodeMetricResults(strings.NewReader(testMetrics), []QueryOptions{{QueryId: "A"}, {QueryId: "B"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := results["B"]; b.HasData || len(b.Times) != 0 {
+		t.Errorf("B: expected no data, got %+v", b)
+	}
+
+	a := results["A"]
+	if !a.HasData || len(a.Groupings) != 2 {
+		t.Fatalf("A: unexpected result %+v", a)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wantTimes := []time.Time{start, start, start.Add(time.Minute)}
+	wantValues := []float64{1, 3, 2}
+	wantOS := []string{"ios", "android", "ios"}
+	os := a.GroupingValues[0]
+	if a.Groupings[1] == "os" {
+		os = a.GroupingValues[1]
+	}
+	for i := range wantTimes {
+		if !a.Times[i].Equal(wantTimes[i]) || a.Values[i] != wantValues[i] || os[i] != wantOS[i] {
+			t.Errorf("point %d: got %v %v %v", i, a.Times[i], a.Values[i], os[i])
+		}
+	}
+}
+
+func TestDecodeMetricResultsErrors(t *testing.T) {
+	for _, body := range []string{``, `[{"isSeperator":true,"dt":"yesterday"}]`, `[{"val":1}`} {
+		if _, err := decodeMetricResults(strings.NewReader(body), []QueryOptions{{QueryId: "A"}}); err == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+// largeMetrics returns a metrics/results body of separators groupings with points values each.
+func largeMetrics(separators int, points int) []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for s := 0; s < separators; s++ {
+		if s > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"isSeperator":true,"dt":%q,"groupings":{"os":"os-%d","country":"c-%d"},"queryId":"A"}`, start.Format(time.RFC3339), s%10, s)
+		for p := 0; p < points; p++ {
+			fmt.Fprintf(&b, `,{"dtSecLater":%d,"val":%d.5,"queryId":"A"}`, p*60, p)
+		}
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+func TestDecodeMetricResultsAllocs(t *testing.T) {
+	body := largeMetrics(10, 1000)
+	qos := []QueryOptions{{QueryId: "A"}}
+	allocs := testing.AllocsPerRun(5, func() {
+		if _, err := decodeMetricResults(bytes.NewReader(body), qos); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1000 {
+		t.Errorf("expected values not to allocate, got %v allocations for 10000 points", allocs)
+	}
+}
+
+// BenchmarkDecodeMetricResults decodes a 1M point response with the streaming decoder
+// and builds its long frame, which copies the columns once.
+func BenchmarkDecodeMetricResults(b *testing.B) {
+	body := largeMetrics(1000, 1000)
+	qos := []QueryOptions{{QueryId: "A"}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results, err := decodeMetricResults(bytes.NewReader(body), qos)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buildLongFrame(qos[0], results["A"])
+	}
+}
+
+// BenchmarkUnmarshalMetricResults decodes the same response the way it was done before
+// the streaming decoder, reading the body, unmarshalling it, copying the rows and
+// appending them to the long frame.
+func BenchmarkUnmarshalMetricResults(b *testing.B) {
+	body := largeMetrics(1000, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		buf.ReadFrom(bytes.NewReader(body))
+		metrics, err := parseResponseData(buf.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+		var finals []MetricResultVal
+		var current_dt_start time.Time
+		var current_groupings map[string]string
+		for _, mr := range metrics {
+			if mr.IsSeperator.Bool {
+				current_dt_start = mr.Dt.Time
+				current_groupings = *mr.Groupings
+				continue
+			}
+			finals = append(finals, MetricResultVal{Dt: current_dt_start.Add(time.Second * time.Duration(mr.DtSecLater)), Val: mr.Val, Groupings: current_groupings, QueryId: "A"})
+		}
+		frame := data.NewFrameOfFieldTypes("Long", 0, data.FieldTypeTime, data.FieldTypeString, data.FieldTypeString, data.FieldTypeFloat64)
+		for _, mrv := range finals {
+			frame.AppendRow(mrv.Dt, mrv.Groupings["os"], mrv.Groupings["country"], mrv.Val)
+		}
+	}
+}
+
+func TestOrderGroupings(t *testing.T) {
+	groupings := map[string]string{"os": "ios", "country": "US", "browser": "safari", "app": "web"}
+	for _, c := range []struct {
+		order []string
+		want  []string
+	}{
+		{[]string{"os", "country", "browser", "app"}, []string{"os", "country", "browser", "app"}},
+		{[]string{"country", "os"}, []string{"country", "os", "app", "browser"}},
+		{[]string{"device", "os", "os"}, []string{"os", "app", "browser", "country"}},
+		{nil, []string{"app", "browser", "country", "os"}},
+	} {
+		if got := orderGroupings(groupings, c.order); !slices.Equal(got, c.want) {
+			t.Errorf("order %v: got %v, want %v", c.order, got, c.want)
+		}
+	}
+}
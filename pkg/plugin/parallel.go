@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// slots returns the semaphore limiting the upstream calls of the instance that run
+// at the same time, across all requests.
+func (d *handler) slots() chan struct{} {
+	d.slotsOnce.Do(func() {
+		d.slotsCh = make(chan struct{}, d.config.Concurrency())
+	})
+	return d.slotsCh
+}
+
+// withSlot runs fn once a slot is free, it returns the context error without running
+// fn when ctx is done first.
+func (d *handler) withSlot(ctx context.Context, fn func()) error {
+	slots := d.slots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-slots }()
+	fn()
+	return nil
+}
+
+// parallelResponses collects the responses of queries running concurrently.
+type parallelResponses struct {
+	d        *handler
+	ctx      context.Context
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	response *backend.QueryDataResponse
+}
+
+func (d *handler) newParallelResponses(ctx context.Context, response *backend.QueryDataResponse) *parallelResponses {
+	return &parallelResponses{d: d, ctx: ctx, response: response}
+}
+
+// run executes fn once a slot is free and stores its responses. refIDs are the
+// queries fn answers, they get the context error when the request is cancelled
+// before fn got to run.
+func (p *parallelResponses) run(refIDs []string, fn func() map[string]*backend.DataResponse) {
+	p.start(func() map[string]*backend.DataResponse {
+		var res map[string]*backend.DataResponse
+		if err := p.d.withSlot(p.ctx, func() { res = fn() }); err != nil {
+			res = make(map[string]*backend.DataResponse, len(refIDs))
+			for _, id := range refIDs {
+				res[id] = &backend.DataResponse{Error: err}
+			}
+		}
+		return res
+	})
+}
+
+// start executes fn right away and stores its responses, fn takes the slots of its
+// upstream calls itself.
+func (p *parallelResponses) start(fn func() map[string]*backend.DataResponse) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		res := fn()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for id, r := range res {
+			p.response.Responses[id] = *r
+		}
+	}()
+}
+
+// wait blocks until all queries finished.
+func (p *parallelResponses) wait() {
+	p.wg.Wait()
+}
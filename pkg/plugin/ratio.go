@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+// ratioMode queries divide their aggregation by the denominator of RatioOptions,
+// e.g. errors / total. Both are fetched as sub queries, see expandQuery, and divided
+// per time and grouping by the backend so the ratio also works in alert rules.
+const ratioMode = "ratio"
+
+// What a ratio with a zero denominator is.
+const (
+	// divideByZeroNull leaves the point out, it is null in wide frames. This is the default.
+	divideByZeroNull = "null"
+	// divideByZeroZero makes the ratio 0.
+	divideByZeroZero = "zero"
+	// divideByZeroInf follows IEEE 754, +Inf or -Inf, and NaN for 0 / 0.
+	divideByZeroInf = "inf"
+)
+
+type RatioOptions struct {
+	DenominatorAggregationId int         `json:"denominatorAggregationId"`
+	DenominatorCalculation   Calculation `json:"denominatorCalculation"`
+	DenominatorPercentile    null.Float  `json:"denominatorPercentile"`
+	DivideByZero             string      `json:"divideByZero"`
+	// Scale multiplies the ratio, 100 for a percentage.
+	Scale null.Float `json:"scale"`
+}
+
+// expandRatio returns the numerator and the denominator of a ratio query. Both are
+// fetched as long results with the grouping keys, the ratio is built like any other
+// result afterwards.
+func expandRatio(qo QueryOptions) []QueryOptions {
+	num := qo
+	num.Mode = ""
+	num.Ratio = nil
+	num.AggregationIds = nil
+	num.Calculations = nil
+	num.Percentiles = nil
+	num.LongResult = null.BoolFrom(true)
+	num.Format = ""
+	num.Instant = false
+	num.UseGroupingAliases = false
+	num.LegendFormat = ""
+	num.QueryId = qo.QueryId + subQuerySeparator + "numerator"
+
+	den := num
+	den.QueryId = qo.QueryId + subQuerySeparator + "denominator"
+	if qo.Ratio != nil {
+		den.AggregationId = qo.Ratio.DenominatorAggregationId
+		if qo.Ratio.DenominatorCalculation != "" {
+			den.Calculation = qo.Ratio.DenominatorCalculation
+		}
+		if qo.Ratio.DenominatorPercentile.Valid {
+			den.Percentile = qo.Ratio.DenominatorPercentile
+		}
+	}
+	if name, ok := qo.AggregationNames[den.AggregationId]; ok {
+		den.AggregationName = name
+	}
+	return []QueryOptions{num, den}
+}
+
+// validRatio reports why the ratio options of qo can't be used, if they can't.
+func validRatio(qo QueryOptions) error {
+	if qo.Ratio == nil {
+		return fmt.Errorf("ratio queries need a denominator")
+	}
+	if len(qo.AggregationIds) > 1 || len(qo.Calculations) > 1 || len(qo.Percentiles) > 1 {
+		return fmt.Errorf("ratio queries take a single aggregation and calculation")
+	}
+	switch qo.Ratio.DivideByZero {
+	case "", divideByZeroNull, divideByZeroZero, divideByZeroInf:
+	default:
+		return fmt.Errorf("unknown divideByZero %q, expected %s, %s or %s", qo.Ratio.DivideByZero, divideByZeroNull, divideByZeroZero, divideByZeroInf)
+	}
+	return nil
+}
+
+// ratioResponse divides the numerator by the denominator for each time and grouping of
+// the denominator. A missing numerator counts as 0, points without a denominator are
+// left out, zero denominators follow RatioOptions.DivideByZero.
+func ratioResponse(qo QueryOptions, num backend.DataResponse, den backend.DataResponse, num_queries int) backend.DataResponse {
+	var response backend.DataResponse
+	if len(den.Frames) == 0 {
+		return response
+	}
+	denRes, err := resultFromLongFrame(den.Frames[0])
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+	}
+	numRes := &queryResult{Groupings: denRes.Groupings, GroupingValues: make([][]string, len(denRes.Groupings))}
+	if len(num.Frames) > 0 {
+		if numRes, err = resultFromLongFrame(num.Frames[0]); err != nil {
+			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		}
+	}
+	if !slices.Equal(numRes.Groupings, denRes.Groupings) {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("ratio %q: numerator grouped by %v but denominator by %v", qo.QueryId, numRes.Groupings, denRes.Groupings))
+	}
+
+	numerators := make(map[string]float64, len(numRes.Times))
+	for i := range numRes.Times {
+		numerators[resultKey(numRes, i)] = numRes.Values[i]
+	}
+	scale := 1.0
+	if qo.Ratio.Scale.Valid {
+		scale = qo.Ratio.Scale.Float64
+	}
+	res := &queryResult{
+		Groupings:      denRes.Groupings,
+		GroupingValues: make([][]string, len(denRes.Groupings)),
+		From:           denRes.From,
+		To:             denRes.To,
+	}
+	for i, t := range denRes.Times {
+		d := denRes.Values[i]
+		n := numerators[resultKey(denRes, i)]
+		var v float64
+		switch {
+		case d != 0:
+			v = n / d * scale
+		case qo.Ratio.DivideByZero == divideByZeroZero:
+			v = 0
+		case qo.Ratio.DivideByZero == divideByZeroInf:
+			v = n / d * scale
+			if n == 0 {
+				v = math.NaN()
+			}
+		default:
+			continue
+		}
+		res.Times = append(res.Times, t)
+		res.Values = append(res.Values, v)
+		for k := range res.Groupings {
+			res.GroupingValues[k] = append(res.GroupingValues[k], denRes.GroupingValues[k][i])
+		}
+	}
+	res.HasData = len(res.Times) > 0
+
+	named := qo
+	if named.Alias == "" && named.AggregationNames != nil {
+		named.Alias = named.AggregationNames[qo.AggregationId] + " / " + named.AggregationNames[qo.Ratio.DenominatorAggregationId]
+	}
+	ProcessFramesFromMR(res, &response, named, num_queries)
+	meta := joinMeta(append(slices.Clone(den.Frames), num.Frames...))
+	updateMeta(response.Frames, func(m *data.FrameMeta) {
+		if meta != nil {
+			m.ExecutedQueryString = meta.ExecutedQueryString
+			m.Custom = meta.Custom
+		}
+	})
+	return response
+}
+
+// resultFromLongFrame reads back the result a long frame was built from.
+func resultFromLongFrame(frame *data.Frame) (*queryResult, error) {
+	if len(frame.Fields) < 2 || frame.Fields[0].Type() != data.FieldTypeTime || frame.Fields[len(frame.Fields)-1].Type() != data.FieldTypeFloat64 {
+		return nil, fmt.Errorf("unexpected frame layout for a ratio")
+	}
+	res := &queryResult{HasData: frame.Rows() > 0}
+	res.Times = make([]time.Time, frame.Rows())
+	res.Values = make([]float64, frame.Rows())
+	for i := range res.Times {
+		res.Times[i] = frame.Fields[0].At(i).(time.Time)
+		res.Values[i] = frame.Fields[len(frame.Fields)-1].At(i).(float64)
+	}
+	for _, f := range frame.Fields[1 : len(frame.Fields)-1] {
+		if f.Type() != data.FieldTypeString {
+			return nil, fmt.Errorf("unexpected frame layout for a ratio")
+		}
+		col := make([]string, f.Len())
+		for i := range col {
+			col[i] = f.At(i).(string)
+		}
+		res.Groupings = append(res.Groupings, f.Name)
+		res.GroupingValues = append(res.GroupingValues, col)
+	}
+	return res, nil
+}
+
+// resultKey identifies point i of res by its time and grouping values.
+func resultKey(res *queryResult, i int) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(res.Times[i].UnixNano(), 10))
+	for k := range res.Groupings {
+		sb.WriteByte(0)
+		sb.WriteString(res.GroupingValues[k][i])
+	}
+	return sb.String()
+}
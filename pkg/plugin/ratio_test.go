@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+// ratioServer answers metrics/results for aggregation 2, the failed logins, with ios
+// at 1 and 3 for 00:00 and 00:01, and for aggregation 1, all logins, with ios at 4 and
+// 0 and android at 10 for 00:00 only.
+func ratioServer(calls *atomic.Int32) *httptest.Server {
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var qos []QueryOptions
+		json.NewDecoder(r.Body).Decode(&qos)
+		var rows []string
+		series := func(id string, os string, values ...float64) {
+			rows = append(rows, fmt.Sprintf(`{"isSeperator":true,"dt":"2024-01-01T00:00:00Z","groupings":{"os":%q},"queryId":%q}`, os, id))
+			for i, v := range values {
+				rows = append(rows, fmt.Sprintf(`{"dtSecLater":%d,"val":%v,"queryId":%q}`, 60*i, v, id))
+			}
+		}
+		for _, qo := range qos {
+			if qo.AggregationId == 2 {
+				series(qo.QueryId, "ios", 1, 3)
+			} else {
+				series(qo.QueryId, "ios", 4, 0)
+				series(qo.QueryId, "android", 10)
+			}
+		}
+		w.Write([]byte("[" + strings.Join(rows, ",") + "]"))
+	})
+	return srv
+}
+
+func TestQueryDataRatio(t *testing.T) {
+	var calls atomic.Int32
+	srv := ratioServer(&calls)
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(refID string, ratio string) backend.DataQuery {
+		return backend.DataQuery{
+			RefID:     refID,
+			TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+			JSON:      []byte(`{"filterId":"f","aggregationId":2,"calculation":"COUNT","fast_mode":true,"mode":"ratio","includeGroupingLabels":true,"ratio":{"denominatorAggregationId":1` + ratio + `}}`),
+		}
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{
+		query("A", ``),
+		query("B", `,"divideByZero":"zero","scale":100`),
+		query("C", `,"divideByZero":"inf"`),
+		query("D", `,"divideByZero":"maybe"`),
+		query("E", `,"denominatorCalculation":"MAX"`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected numerators and denominators in a single call, got %d", n)
+	}
+
+	for refID, want := range map[string]string{
+		"A": "Failed / All: os=android: 0, Failed / All: os=ios: 0.25",
+		"B": "Failed / All: os=android: 0 <nil>, Failed / All: os=ios: 25 0",
+		"C": "Failed / All: os=android: 0 <nil>, Failed / All: os=ios: 0.25 +Inf",
+	} {
+		res := resp.Responses[refID]
+		if res.Error != nil || len(res.Frames) != 1 {
+			t.Fatalf("%s: expected a single frame, got %v", refID, res)
+		}
+		frame := res.Frames[0]
+		var got []string
+		for _, f := range frame.Fields[1:] {
+			s := f.Config.DisplayNameFromDS + ":"
+			for i := 0; i < f.Len(); i++ {
+				v, _ := f.NullableFloatAt(i)
+				s += fmt.Sprintf(" %v", deref(v))
+			}
+			got = append(got, s)
+		}
+		if s := strings.Join(got, ", "); s != want {
+			t.Errorf("%s: got %s, want %s", refID, s, want)
+		}
+		if frame.Fields[1].Name != "Failed / All" {
+			t.Errorf("%s: got value name %q", refID, frame.Fields[1].Name)
+		}
+		if !strings.Contains(frame.Meta.ExecutedQueryString, "A#numerator") {
+			t.Errorf("%s: expected the executed batch in the meta, got %q", refID, frame.Meta.ExecutedQueryString)
+		}
+	}
+	for _, refID := range []string{"D", "E"} {
+		if resp.Responses[refID].Error == nil {
+			t.Errorf("%s: expected a validation error", refID)
+		}
+	}
+}
+
+func TestRatioResponseNaN(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	long := func(v float64) backend.DataResponse {
+		res := &queryResult{HasData: true, Times: []time.Time{from}, Values: []float64{v}}
+		return backend.DataResponse{Frames: []*data.Frame{buildLongFrame(QueryOptions{}, res)}}
+	}
+	qo := QueryOptions{QueryId: "A", LongResult: null.BoolFrom(true), Ratio: &RatioOptions{DivideByZero: divideByZeroInf}}
+	res := ratioResponse(qo, long(0), long(0), 1)
+	if v := res.Frames[0].Fields[1].At(0).(float64); !math.IsNaN(v) {
+		t.Errorf("0 / 0 should be NaN, got %v", v)
+	}
+	res = ratioResponse(qo, backend.DataResponse{}, long(5), 1)
+	if v := res.Frames[0].Fields[1].At(0).(float64); v != 0 {
+		t.Errorf("a missing numerator counts as 0, got %v", v)
+	}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheHit     = "hit"
+	cacheMiss    = "miss"
+	cachePartial = "partial"
+	// cacheCoalesced marks results shared with an identical call of another request.
+	cacheCoalesced = "coalesced"
+
+	// maxResultCacheEntries bounds the memory used by the result cache of an instance.
+	maxResultCacheEntries = 1000
+	// defaultQueryInterval is used to snap time ranges when Grafana didn't send an interval.
+	defaultQueryInterval = time.Minute
+)
+
+type resultCacheEntry struct {
+	res     *queryResult
+	expires time.Time
+}
+
+// resultCache keeps the parsed results of metrics/results queries for a short while,
+// so viewers of the same dashboard share them. The zero value is ready to use.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]resultCacheEntry
+}
+
+func (c *resultCache) get(key string) (*queryResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.res, true
+}
+
+func (c *resultCache) set(key string, res *queryResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]resultCacheEntry)
+	}
+	now := time.Now()
+	if len(c.entries) >= maxResultCacheEntries {
+		c.evict(now)
+	}
+	c.entries[key] = resultCacheEntry{res: res, expires: now.Add(ttl)}
+}
+
+// evict drops expired entries, or the entry closest to expiry when none expired.
+func (c *resultCache) evict(now time.Time) {
+	var oldest string
+	var oldestExpiry time.Time
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == "" || e.expires.Before(oldestExpiry) {
+			oldest, oldestExpiry = k, e.expires
+		}
+	}
+	if len(c.entries) >= maxResultCacheEntries {
+		delete(c.entries, oldest)
+	}
+}
+
+// resultCacheKey identifies the results of a query. Only the options sent to the API
+// are part of the key, and the time range is snapped to the query interval so
+// refreshes within the same interval share an entry. Options that only change how
+// frames are built, such as the alias, are left out.
+func resultCacheKey(token string, qo QueryOptions) string {
+	return queryCacheKey(token, qo, true)
+}
+
+// seriesCacheKey identifies the series of a query regardless of its time range.
+func seriesCacheKey(token string, qo QueryOptions) string {
+	return queryCacheKey(token, qo, false)
+}
+
+func queryCacheKey(token string, qo QueryOptions, withRange bool) string {
+	interval := qo.interval()
+	key := struct {
+		Token                      string
+		FilterId                   string
+		AggregationId              int
+		Calculation                Calculation
+		Percentile                 float64
+		GroupingFilters            []GroupingOrFilterItem
+		LimitN                     *int
+		LimitType                  *LimitType
+		ExcludeEmpty               bool
+		IncludeIncompleteIntervals bool
+		RecalculatedInterval       *RecalculateInterval
+		Start                      int64
+		End                        int64
+	}{
+		Token:                      token,
+		FilterId:                   qo.FilterId,
+		AggregationId:              qo.AggregationId,
+		Calculation:                qo.Calculation,
+		Percentile:                 qo.Percentile.Float64,
+		GroupingFilters:            normalizeGroupingFilters(qo.GroupingFilters),
+		LimitN:                     qo.LimitN,
+		LimitType:                  qo.LimitType,
+		ExcludeEmpty:               qo.ExcludeEmpty,
+		IncludeIncompleteIntervals: qo.IncludeIncompleteIntervals,
+		RecalculatedInterval:       qo.RecalculatedInterval,
+	}
+	if withRange {
+		key.Start = snapTime(qo.StartTime, interval)
+		key.End = snapTime(qo.EndTime, interval)
+	}
+	b, _ := json.Marshal(key)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeGroupingFilters sorts grouping filters and their values, their order
+// doesn't change the result.
+func normalizeGroupingFilters(gfs *[]GroupingOrFilterItem) []GroupingOrFilterItem {
+	if gfs == nil {
+		return nil
+	}
+	out := make([]GroupingOrFilterItem, len(*gfs))
+	for i, gf := range *gfs {
+		out[i] = gf
+		if gf.Filters != nil {
+			filters := slices.Clone(*gf.Filters)
+			slices.Sort(filters)
+			out[i].Filters = &filters
+		}
+	}
+	slices.SortFunc(out, func(a, b GroupingOrFilterItem) int {
+		return strings.Compare(a.Grouping, b.Grouping)
+	})
+	return out
+}
+
+// snapTime floors an RFC3339 time to the interval, returning unix seconds.
+func snapTime(v string, interval time.Duration) int64 {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0
+	}
+	return t.Truncate(interval).Unix()
+}
+
+// interval is the interval Grafana asked for, or a minute when it didn't send one.
+func (qo QueryOptions) interval() time.Duration {
+	if qo.Interval < time.Second {
+		return defaultQueryInterval
+	}
+	return qo.Interval
+}
+
+// ResultTTL is how long the results of qo may be cached at now. Results of a range
+// ending before the current interval are final and kept for the full result TTL.
+// Otherwise the trailing interval is still filling up: when it is part of the result
+// the incomplete TTL applies, when it isn't the result holds until that interval
+// completes.
+func (s DatasourceSettings) ResultTTL(qo QueryOptions, now time.Time) time.Duration {
+	if s.ResultCacheSeconds < 0 {
+		return 0
+	}
+	ttl := time.Duration(s.ResultCacheSeconds) * time.Second
+	end, err := time.Parse(time.RFC3339, qo.EndTime)
+	if err != nil {
+		return 0
+	}
+	interval := qo.interval()
+	current := now.Truncate(interval)
+	if end.Before(current) {
+		return ttl
+	}
+	if qo.IncludeIncompleteIntervals {
+		if s.IncompleteResultCacheSeconds < 0 {
+			return 0
+		}
+		return min(ttl, time.Duration(s.IncompleteResultCacheSeconds)*time.Second)
+	}
+	return min(ttl, current.Add(interval).Sub(now))
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	defaultHost       = "app.aggregations.io"
+	defaultAPIVersion = "v1"
+
+	defaultTimeoutSeconds      = 10
+	defaultMaxRetries          = 2
+	defaultRetryBackoffMs      = 250
+	defaultRetryMaxBackoffMs   = 5000
+	defaultMaxRetryAfterSecond = 30
+
+	defaultFilterDefinitionCacheSeconds = 60
+	defaultResultCacheSeconds           = 300
+	defaultIncompleteResultCacheSeconds = 10
+	defaultIncrementalCacheSeconds      = 900
+
+	defaultMaxBatchSize   = 10
+	defaultMaxConcurrency = 4
+)
+
+// regionLabel is what a region may be, a single DNS label since it is prefixed to
+// the default host.
+var regionLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// DatasourceSettings are the per-instance options stored in the datasource jsonData.
+// All fields are optional, an empty configuration talks to the public API.
+type DatasourceSettings struct {
+	// BaseURL overrides the scheme and host of the API, e.g. a staging tenant or a
+	// local stand-in server. When set, Region is ignored.
+	BaseURL string `json:"baseUrl"`
+	// Region selects a regional deployment, which is prefixed to the default host.
+	Region string `json:"region"`
+	// APIVersion is the version segment of the API path, defaults to v1.
+	APIVersion string `json:"apiVersion"`
+
+	// TimeoutSeconds bounds a single upstream attempt, retries get a fresh timeout.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+	// MaxRetries is the number of retries after the first attempt, 0 disables retrying.
+	MaxRetries *int `json:"maxRetries"`
+	// RetryBackoffMs is the base of the exponential backoff between attempts.
+	RetryBackoffMs int `json:"retryBackoffMs"`
+	// RetryMaxBackoffMs caps the backoff between attempts.
+	RetryMaxBackoffMs int `json:"retryMaxBackoffMs"`
+	// MaxRetryAfterSeconds is the longest Retry-After we are willing to wait for,
+	// a 429 asking for more is returned to the caller as is.
+	MaxRetryAfterSeconds int `json:"maxRetryAfterSeconds"`
+
+	// FilterDefinitionCacheSeconds is how long filter definitions are cached, a negative
+	// value disables the cache.
+	FilterDefinitionCacheSeconds int `json:"filterDefinitionCacheSeconds"`
+	// ResultCacheSeconds is how long query results made of complete intervals are
+	// cached, a negative value disables the result cache.
+	ResultCacheSeconds int `json:"resultCacheSeconds"`
+	// IncompleteResultCacheSeconds is how long results including the trailing,
+	// incomplete interval are cached, a negative value disables caching them.
+	IncompleteResultCacheSeconds int `json:"incompleteResultCacheSeconds"`
+	// IncrementalCacheSeconds is how long the series of a query are kept to only fetch
+	// the new tail on the next refresh, a negative value disables incremental fetching.
+	IncrementalCacheSeconds int `json:"incrementalCacheSeconds"`
+
+	// MaxBatchSize caps the number of fast mode queries sent in a single call.
+	MaxBatchSize int `json:"maxBatchSize"`
+	// MaxConcurrentQueries limits the upstream calls running at the same time.
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+}
+
+// LoadSettings parses the jsonData of the datasource instance.
+func LoadSettings(settings backend.DataSourceInstanceSettings) (DatasourceSettings, error) {
+	var s DatasourceSettings
+	if len(settings.JSONData) > 0 {
+		if err := json.Unmarshal(settings.JSONData, &s); err != nil {
+			return s, fmt.Errorf("parse jsonData: %w", err)
+		}
+	}
+	s.BaseURL = strings.TrimSpace(s.BaseURL)
+	s.Region = strings.ToLower(strings.TrimSpace(s.Region))
+	s.APIVersion = strings.Trim(strings.TrimSpace(s.APIVersion), "/")
+
+	if s.BaseURL != "" {
+		u, err := url.Parse(s.BaseURL)
+		if err != nil {
+			return s, fmt.Errorf("parse baseUrl: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return s, fmt.Errorf("baseUrl %q must be an absolute http(s) URL", s.BaseURL)
+		}
+	}
+	if s.Region != "" && !regionLabel.MatchString(s.Region) {
+		return s, fmt.Errorf("region %q must be a single DNS label, e.g. eu", s.Region)
+	}
+
+	if s.TimeoutSeconds <= 0 {
+		s.TimeoutSeconds = defaultTimeoutSeconds
+	}
+	if s.MaxRetries == nil || *s.MaxRetries < 0 {
+		retries := defaultMaxRetries
+		s.MaxRetries = &retries
+	}
+	if s.RetryBackoffMs <= 0 {
+		s.RetryBackoffMs = defaultRetryBackoffMs
+	}
+	if s.RetryMaxBackoffMs < s.RetryBackoffMs {
+		s.RetryMaxBackoffMs = max(defaultRetryMaxBackoffMs, s.RetryBackoffMs)
+	}
+	if s.MaxRetryAfterSeconds <= 0 {
+		s.MaxRetryAfterSeconds = defaultMaxRetryAfterSecond
+	}
+	if s.FilterDefinitionCacheSeconds == 0 {
+		s.FilterDefinitionCacheSeconds = defaultFilterDefinitionCacheSeconds
+	}
+	if s.ResultCacheSeconds == 0 {
+		s.ResultCacheSeconds = defaultResultCacheSeconds
+	}
+	if s.IncompleteResultCacheSeconds == 0 {
+		s.IncompleteResultCacheSeconds = defaultIncompleteResultCacheSeconds
+	}
+	if s.IncrementalCacheSeconds == 0 {
+		s.IncrementalCacheSeconds = defaultIncrementalCacheSeconds
+	}
+	if s.MaxBatchSize <= 0 {
+		s.MaxBatchSize = defaultMaxBatchSize
+	}
+	if s.MaxConcurrentQueries <= 0 {
+		s.MaxConcurrentQueries = defaultMaxConcurrency
+	}
+	return s, nil
+}
+
+// FilterDefinitionTTL is how long fetched filter definitions stay cached, 0 when disabled.
+func (s DatasourceSettings) FilterDefinitionTTL() time.Duration {
+	if s.FilterDefinitionCacheSeconds < 0 {
+		return 0
+	}
+	return time.Duration(s.FilterDefinitionCacheSeconds) * time.Second
+}
+
+// IncrementalTTL is how long series are kept for incremental fetches, 0 when disabled.
+func (s DatasourceSettings) IncrementalTTL() time.Duration {
+	if s.IncrementalCacheSeconds < 0 {
+		return 0
+	}
+	return time.Duration(s.IncrementalCacheSeconds) * time.Second
+}
+
+// Concurrency is the number of upstream calls allowed to run at the same time.
+func (s DatasourceSettings) Concurrency() int {
+	if s.MaxConcurrentQueries <= 0 {
+		return defaultMaxConcurrency
+	}
+	return s.MaxConcurrentQueries
+}
+
+// Timeout is the time allowed for a single upstream attempt.
+func (s DatasourceSettings) Timeout() time.Duration {
+	if s.TimeoutSeconds <= 0 {
+		return defaultTimeoutSeconds * time.Second
+	}
+	return time.Duration(s.TimeoutSeconds) * time.Second
+}
+
+// RetryPolicy returns the retry policy of the instance.
+func (s DatasourceSettings) RetryPolicy() retryPolicy {
+	p := retryPolicy{
+		maxRetries:    defaultMaxRetries,
+		backoff:       time.Duration(s.RetryBackoffMs) * time.Millisecond,
+		maxBackoff:    time.Duration(s.RetryMaxBackoffMs) * time.Millisecond,
+		maxRetryAfter: time.Duration(s.MaxRetryAfterSeconds) * time.Second,
+	}
+	if s.MaxRetries != nil {
+		p.maxRetries = *s.MaxRetries
+	}
+	return p
+}
+
+// APIBase returns the root all endpoint paths are resolved against, always ending in a slash.
+func (s DatasourceSettings) APIBase() string {
+	base := s.BaseURL
+	if base == "" {
+		host := defaultHost
+		if s.Region != "" {
+			host = s.Region + "." + defaultHost
+		}
+		base = "https://" + host
+	}
+	version := s.APIVersion
+	if version == "" {
+		version = defaultAPIVersion
+	}
+	return strings.TrimRight(base, "/") + "/api/" + version + "/"
+}
+
+// url builds the full URL of an API endpoint such as "metrics/results".
+func (s DatasourceSettings) url(path string) string {
+	return s.APIBase() + strings.TrimLeft(path, "/")
+}
+
+// apiToken reads the API key of the datasource the request was made for.
+func apiToken(pluginCtx backend.PluginContext) string {
+	if pluginCtx.DataSourceInstanceSettings == nil {
+		return ""
+	}
+	return pluginCtx.DataSourceInstanceSettings.DecryptedSecureJSONData["apiKey"]
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestLoadSettings(t *testing.T) {
+	cases := []struct {
+		json string
+		url  string
+	}{
+		{``, "https://app.aggregations.io/api/v1/metrics/results"},
+		{`{}`, "https://app.aggregations.io/api/v1/metrics/results"},
+		{`{"region":"eu"}`, "https://eu.app.aggregations.io/api/v1/metrics/results"},
+		{`{"region":" US-East-1 "}`, "https://us-east-1.app.aggregations.io/api/v1/metrics/results"},
+		{`{"apiVersion":"v2"}`, "https://app.aggregations.io/api/v2/metrics/results"},
+		{`{"baseUrl":"http://localhost:5060/","region":"eu"}`, "http://localhost:5060/api/v1/metrics/results"},
+	}
+	for _, c := range cases {
+		s, err := LoadSettings(backend.DataSourceInstanceSettings{JSONData: []byte(c.json)})
+		if err != nil {
+			t.Fatalf("%s: %v", c.json, err)
+		}
+		if got := s.url("metrics/results"); got != c.url {
+			t.Errorf("%s: got %q, want %q", c.json, got, c.url)
+		}
+	}
+
+	if _, err := LoadSettings(backend.DataSourceInstanceSettings{JSONData: []byte(`{"baseUrl":"localhost:5060"}`)}); err == nil {
+		t.Error("expected an error for a base URL without scheme")
+	}
+	for _, region := range []string{"eu.evil.com/", "evil.com#", "eu_1", "-eu"} {
+		if _, err := LoadSettings(backend.DataSourceInstanceSettings{JSONData: []byte(`{"region":"` + region + `"}`)}); err == nil {
+			t.Errorf("expected an error for region %q", region)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Streams run a query on Grafana Live channels of the form "query/<anything>", the
+// subscription data being the query model as sent to QueryData, with its intervalMs as
+// the polling period and the from of the panel, in epoch milliseconds, as the start of
+// the backfill. Every subscription to the same query shares a single poller, which
+// tails the new intervals and pushes each subscriber the rows appended since the last
+// ones it received.
+
+const (
+	streamPathPrefix     = "query/"
+	streamBackfill       = 15 * time.Minute
+	streamDefaultPoll    = 10 * time.Second
+	streamSubscriberSize = 16
+)
+
+// streamMinPollInterval keeps a small intervalMs from hammering the API.
+var streamMinPollInterval = time.Second
+
+var streamPollers = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "aggregations_io",
+	Name:      "stream_pollers",
+	Help:      "Number of upstream pollers running for Grafana Live streams.",
+})
+
+var (
+	_ backend.StreamHandler = (*handler)(nil)
+)
+
+// streamQuery is a query being streamed, normalized so that identical queries from
+// different panels share their poller, from being the start of the subscription.
+type streamQuery struct {
+	query  []byte
+	period time.Duration
+	from   time.Time
+}
+
+// parseStreamQuery reads the subscription data of a stream. Only plain queries can
+// be streamed, they are polled as long frames whatever their format.
+func parseStreamQuery(path string, raw json.RawMessage) (streamQuery, error) {
+	if !strings.HasPrefix(path, streamPathPrefix) {
+		return streamQuery{}, fmt.Errorf("unknown stream path %q", path)
+	}
+	var qo QueryOptions
+	if err := json.Unmarshal(raw, &qo); err != nil {
+		return streamQuery{}, fmt.Errorf("stream query: %w", err)
+	}
+	if qo.FilterId == "" {
+		return streamQuery{}, errors.New("stream query: missing filter")
+	}
+	if qo.Expression != "" {
+		return streamQuery{}, errors.New("stream query: expressions can't be streamed")
+	}
+	var interval struct {
+		IntervalMs int64 `json:"intervalMs"`
+		From       int64 `json:"from"`
+	}
+	json.Unmarshal(raw, &interval)
+	from := time.Now().Add(-streamBackfill)
+	if interval.From > 0 {
+		from = time.UnixMilli(interval.From)
+	}
+
+	// what differs between panels showing the same query
+	qo.QueryId, qo.StartTime, qo.EndTime = "", "", ""
+	qo.Hide = null.Bool{}
+	qo.LongResult = null.BoolFrom(true)
+	qo.Format = ""
+	qo.Instant = false
+	query, err := json.Marshal(qo)
+	if err != nil {
+		return streamQuery{}, fmt.Errorf("stream query: %w", err)
+	}
+	period := time.Duration(interval.IntervalMs) * time.Millisecond
+	if period <= 0 {
+		period = streamDefaultPoll
+	}
+	return streamQuery{query: query, period: max(period, streamMinPollInterval), from: from}, nil
+}
+
+// SubscribeStream accepts subscriptions to queries that can be streamed.
+func (d *handler) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if !strings.HasPrefix(req.Path, streamPathPrefix) {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if _, err := parseStreamQuery(req.Path, req.Data); err != nil {
+		backend.Logger.Debug("Refusing stream subscription", "path", req.Path, "error", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream refuses publications, streams are read only.
+func (d *handler) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream pushes the rows appended to the query of the stream until Grafana has no
+// subscriber left on the channel.
+func (d *handler) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	sq, err := parseStreamQuery(req.Path, req.Data)
+	if err != nil {
+		return err
+	}
+	key := coalesceKey(apiToken(req.PluginContext), sq.query) + "/" + sq.period.String()
+	frames := d.streams.subscribe(key, sq.from, func(p *streamPoller) {
+		p.pluginCtx = req.PluginContext
+		p.query = sq
+		go d.poll(p)
+	})
+	defer d.streams.unsubscribe(key, frames)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case frame := <-frames:
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamPoller polls a query for the streams subscribed to it.
+type streamPoller struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	pluginCtx   backend.PluginContext
+	query       streamQuery
+	subscribers map[chan *data.Frame]*streamSubscriber
+}
+
+// streamSubscriber is a stream of a poller.
+type streamSubscriber struct {
+	frames chan *data.Frame
+	// sent is the time of the last row pushed, just before the start of the
+	// subscription until the backfill is
+	sent time.Time
+}
+
+// streamHub keeps a poller per streamed query while it has subscribers. The zero value
+// is ready to use.
+type streamHub struct {
+	mu      sync.Mutex
+	pollers map[string]*streamPoller
+}
+
+// subscribe returns a channel receiving the rows of the query identified by key from
+// time from, calling start with a new poller when none is running for it.
+func (h *streamHub) subscribe(key string, from time.Time, start func(p *streamPoller)) chan *data.Frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pollers == nil {
+		h.pollers = make(map[string]*streamPoller)
+	}
+	frames := make(chan *data.Frame, streamSubscriberSize)
+	p, ok := h.pollers[key]
+	if !ok {
+		p = &streamPoller{subscribers: make(map[chan *data.Frame]*streamSubscriber)}
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+		h.pollers[key] = p
+		streamPollers.Inc()
+		start(p)
+	}
+	p.subscribers[frames] = &streamSubscriber{frames: frames, sent: from.Add(-time.Nanosecond)}
+	return frames
+}
+
+// unsubscribe removes a subscriber, stopping the poller once it has none left.
+func (h *streamHub) unsubscribe(key string, frames chan *data.Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.pollers[key]
+	if !ok {
+		return
+	}
+	delete(p.subscribers, frames)
+	if len(p.subscribers) == 0 {
+		p.cancel()
+		delete(h.pollers, key)
+		streamPollers.Dec()
+	}
+}
+
+// since returns the time of the last row every subscriber of p received, the start of
+// the earliest subscription still waiting for its backfill.
+func (h *streamHub) since(p *streamPoller) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var since time.Time
+	first := true
+	for _, s := range p.subscribers {
+		if first || s.sent.Before(since) {
+			since, first = s.sent, false
+		}
+	}
+	return since
+}
+
+// publish hands every subscriber of p the rows of frame it has not received yet. A
+// subscriber too slow to keep up gets its rows on a later poll rather than holding
+// back the others.
+func (h *streamHub) publish(p *streamPoller, frame *data.Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range p.subscribers {
+		appended, last := appendedRows(frame, s.sent)
+		if appended == nil {
+			continue
+		}
+		select {
+		case s.frames <- appended:
+			s.sent = last
+		default:
+			backend.Logger.Debug("Holding back streamed rows for a slow subscriber")
+		}
+	}
+}
+
+// close stops every poller, their streams end with the instance.
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, p := range h.pollers {
+		p.cancel()
+		delete(h.pollers, key)
+		streamPollers.Dec()
+	}
+}
+
+// poll runs the query of p every period until p is stopped.
+func (d *handler) poll(p *streamPoller) {
+	ticker := time.NewTicker(p.query.period)
+	defer ticker.Stop()
+	for {
+		if frame, err := d.pollOnce(p, d.streams.since(p)); err != nil && p.ctx.Err() == nil {
+			backend.Logger.Warn("Stream poll failed", "error", err)
+		} else if frame != nil {
+			d.streams.publish(p, frame)
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce fetches the query from since and returns the long frame of the result, nil
+// when it is empty.
+func (d *handler) pollOnce(p *streamPoller, since time.Time) (*data.Frame, error) {
+	resp, err := d.QueryData(p.ctx, &backend.QueryDataRequest{
+		PluginContext: p.pluginCtx,
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			Interval:  p.query.period,
+			TimeRange: backend.TimeRange{From: since, To: time.Now()},
+			JSON:      p.query.query,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if len(res.Frames) == 0 {
+		return nil, nil
+	}
+	return res.Frames[0], nil
+}
+
+// appendedRows returns the rows of a long frame after time sent and before its latest
+// time, along with the time of the last of them. It returns nil when there are none.
+// The latest interval may still be filling up, its rows are left for the next poll.
+func appendedRows(frame *data.Frame, sent time.Time) (*data.Frame, time.Time) {
+	if len(frame.Fields) == 0 || frame.Fields[0].Type() != data.FieldTypeTime {
+		return nil, sent
+	}
+	times := frame.Fields[0]
+	var latest time.Time
+	for i := 0; i < times.Len(); i++ {
+		if t := times.At(i).(time.Time); t.After(latest) {
+			latest = t
+		}
+	}
+	appended := frame.EmptyCopy()
+	appended.Meta = nil
+	last := sent
+	for i := 0; i < times.Len(); i++ {
+		t := times.At(i).(time.Time)
+		if !t.After(sent) || !t.Before(latest) {
+			continue
+		}
+		appended.AppendRow(frame.RowCopy(i)...)
+		if t.After(last) {
+			last = t
+		}
+	}
+	if appended.Rows() == 0 {
+		return nil, sent
+	}
+	return appended, last
+}
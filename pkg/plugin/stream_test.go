@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// frameSender collects the frames pushed on a stream.
+type frameSender chan *data.Frame
+
+func (s frameSender) Send(p *backend.StreamPacket) error {
+	var frame data.Frame
+	if err := json.Unmarshal(p.Data, &frame); err != nil {
+		return err
+	}
+	s <- &frame
+	return nil
+}
+
+func TestAppendedRows(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("Long",
+		data.NewField("time", nil, []time.Time{start, start, start.Add(time.Minute), start.Add(2 * time.Minute)}),
+		data.NewField("os", nil, []string{"ios", "android", "ios", "ios"}),
+		data.NewField("Logins", nil, []float64{1, 2, 3, 4}),
+	)
+
+	appended, last := appendedRows(frame, time.Time{})
+	if appended.Rows() != 3 || !last.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected the rows before the latest interval, got %d rows up to %v", appended.Rows(), last)
+	}
+	appended, last = appendedRows(frame, start)
+	if appended.Rows() != 1 || appended.Fields[2].At(0).(float64) != 3 || !last.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected the rows after the last one sent, got %d rows up to %v", appended.Rows(), last)
+	}
+	if appended, last = appendedRows(frame, start.Add(time.Minute)); appended != nil || !last.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected nothing new, got %v", appended)
+	}
+}
+
+func TestStreamHubHoldsBackRows(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	intervals := func(n int) *data.Frame {
+		times := make([]time.Time, n)
+		values := make([]float64, n)
+		for i := range n {
+			times[i], values[i] = start.Add(time.Duration(i)*time.Minute), float64(i)
+		}
+		return data.NewFrame("Long", data.NewField("time", nil, times), data.NewField("Logins", nil, values))
+	}
+
+	var hub streamHub
+	var p *streamPoller
+	fast := hub.subscribe("q", start, func(started *streamPoller) { p = started })
+	slow := hub.subscribe("q", start.Add(time.Minute), func(*streamPoller) { t.Error("expected the poller to be shared") })
+	for range streamSubscriberSize {
+		slow <- nil
+	}
+
+	hub.publish(p, intervals(3))
+	if frame := <-fast; frame.Rows() != 2 {
+		t.Fatalf("expected the rows before the latest interval, got %s", frameTable(frame))
+	}
+	if since := hub.since(p); !since.Before(start.Add(time.Minute)) {
+		t.Errorf("expected the next poll to go back to the slow subscriber, got %v", since)
+	}
+
+	for range streamSubscriberSize {
+		<-slow
+	}
+	hub.publish(p, intervals(4))
+	if frame := <-fast; frame.Rows() != 1 || frame.Fields[1].At(0).(float64) != 2 {
+		t.Errorf("expected the new interval only, got %s", frameTable(frame))
+	}
+	if frame := <-slow; frame.Rows() != 2 || frame.Fields[1].At(0).(float64) != 1 {
+		t.Errorf("expected the held back rows from the start of the subscription, got %s", frameTable(frame))
+	}
+	if since := hub.since(p); !since.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("got %v", since)
+	}
+	hub.close()
+}
+
+func TestRunStreamSharesPoller(t *testing.T) {
+	defer func(d time.Duration) { streamMinPollInterval = d }(streamMinPollInterval)
+	streamMinPollInterval = 10 * time.Millisecond
+
+	// every call has one more interval than the previous one
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	var calls atomic.Int32
+	srv, _ := apiServer(func(w http.ResponseWriter, r *http.Request) {
+		n := min(int(calls.Add(1)), 5)
+		var sb strings.Builder
+		fmt.Fprintf(&sb, `[{"isSeperator":true,"dt":%q,"groupings":{"os":"ios","country":"US"},"queryId":"A"}`, start.Format(time.RFC3339))
+		for i := 0; i <= n; i++ {
+			fmt.Fprintf(&sb, `,{"dtSecLater":%d,"val":%d,"queryId":"A"}`, i*60, i)
+		}
+		sb.WriteString("]")
+		w.Write([]byte(sb.String()))
+	})
+	defer srv.Close()
+	ds := newTestHandler(t, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	senders := []frameSender{make(frameSender, 16), make(frameSender, 16)}
+	for i, sender := range senders {
+		req := &backend.RunStreamRequest{
+			Path: fmt.Sprintf("query/panel-%d", i),
+			Data: json.RawMessage(`{"refId":"` + string(rune('A'+i)) + `","filterId":"f","aggregationId":1,"calculation":"COUNT","intervalMs":10}`),
+		}
+		if sub, err := ds.SubscribeStream(ctx, &backend.SubscribeStreamRequest{Path: req.Path, Data: req.Data}); err != nil || sub.Status != backend.SubscribeStreamStatusOK {
+			t.Fatalf("subscribe: %v %v", sub, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ds.RunStream(ctx, req, backend.NewStreamSender(sender)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	for i, sender := range senders {
+		var values []float64
+		for len(values) < 4 {
+			select {
+			case frame := <-sender:
+				value := frame.Fields[len(frame.Fields)-1]
+				for r := 0; r < frame.Rows(); r++ {
+					v, _ := value.NullableFloatAt(r)
+					values = append(values, *v)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream %d: timed out with %v", i, values)
+			}
+		}
+		if i == 0 {
+			ds.streams.mu.Lock()
+			if n := len(ds.streams.pollers); n != 1 {
+				t.Errorf("expected a single poller for both streams, got %d", n)
+			}
+			ds.streams.mu.Unlock()
+		}
+		for j, v := range values {
+			if v != float64(j) {
+				t.Fatalf("stream %d: expected each interval once and in order, got %v", i, values)
+			}
+		}
+	}
+
+	cancel()
+	wg.Wait()
+	if n := len(ds.streams.pollers); n != 0 {
+		t.Errorf("expected the poller to stop with its streams, got %d", n)
+	}
+}
+
+func TestSubscribeStream(t *testing.T) {
+	ds := &handler{}
+	res, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "other/A"})
+	if err != nil || res.Status != backend.SubscribeStreamStatusNotFound {
+		t.Errorf("expected unknown paths not to be found, got %v %v", res, err)
+	}
+	res, err = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "query/A", Data: json.RawMessage(`{"filterId":"f","mode":"expression","expression":"$A * 2"}`)})
+	if err != nil || res.Status != backend.SubscribeStreamStatusPermissionDenied {
+		t.Errorf("expected expressions to be refused, got %v %v", res, err)
+	}
+}
+
+func TestParseStreamQueryFrom(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sq, err := parseStreamQuery("query/A", json.RawMessage(fmt.Sprintf(`{"filterId":"f","intervalMs":60000,"from":%d}`, from.UnixMilli())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sq.from.Equal(from) {
+		t.Errorf("expected the backfill to start with the panel, got %v", sq.from)
+	}
+	other, _ := parseStreamQuery("query/B", json.RawMessage(`{"filterId":"f","intervalMs":60000}`))
+	if string(other.query) != string(sq.query) {
+		t.Errorf("expected panels with different ranges to share the query, got %s and %s", sq.query, other.query)
+	}
+	if since := time.Since(other.from); since < streamBackfill-time.Minute || since > streamBackfill+time.Minute {
+		t.Errorf("expected the default backfill without a from, got %v", other.from)
+	}
+}
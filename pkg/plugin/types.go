@@ -3,6 +3,7 @@ package handler
 import (
 	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"gopkg.in/guregu/null.v4"
 )
 
@@ -59,7 +60,10 @@ type QueryOptions struct {
 	EndTime                    string                  `json:"endTime"`
 	GroupingFilters            *[]GroupingOrFilterItem `json:"groupingFilters"`
 	AggregationId              int                     `json:"aggregationId"`
+	AggregationIds             []int                   `json:"aggregationIds,omitempty"`
 	Calculation                Calculation             `json:"calculation"`
+	Calculations               []Calculation           `json:"calculations,omitempty"`
+	Percentiles                []float64               `json:"percentiles,omitempty"`
 	LimitN                     *int                    `json:"limit"`
 	LimitType                  *LimitType              `json:"limitType"`
 	Alias                      string                  `json:"alias"`
@@ -67,7 +71,12 @@ type QueryOptions struct {
 	Hide                       null.Bool               `json:"hide"`
 	FilterDefinitionName       string                  `json:"filterDefinitionName"`
 	LongResult                 null.Bool               `json:"longResult"`
+	Format                     string                  `json:"format,omitempty"`
+	Reducer                    string                  `json:"reducer,omitempty"`
+	Instant                    bool                    `json:"instant,omitempty"`
 	IncludeGroupingLabels      bool                    `json:"includeGroupingLabels"`
+	UseGroupingAliases         bool                    `json:"useGroupingAliases"`
+	LegendFormat               string                  `json:"legendFormat"`
 	SpecificGrouping           string                  `json:"groupingName"`
 	Mode                       string                  `json:"mode"`
 	IncludeAggregateOption     bool                    `json:"includeAggregateOption"`
@@ -78,6 +87,85 @@ type QueryOptions struct {
 	FastMode                   bool                    `json:"fast_mode"`
 	ShouldRecalculate          bool                    `json:"shouldRecalculate"`
 	RecalculatedInterval       *RecalculateInterval    `json:"recalculatedInterval"`
+	Ratio                      *RatioOptions           `json:"ratio,omitempty"`
+	Expression                 string                  `json:"expression,omitempty"`
+	Interval                   time.Duration           `json:"-"`
+	// GroupingOrder is the order of the groupings in the filter definition, grouping
+	// columns follow it.
+	GroupingOrder []string `json:"-"`
+	// GroupingAliases maps groupings to the alias the filter definition gives them.
+	GroupingAliases map[string]string `json:"-"`
+	// AggregationName is the name of the aggregation in the filter definition.
+	AggregationName string `json:"-"`
+	// AggregationNames are the names of the aggregations asked for, by id.
+	AggregationNames map[int]string `json:"-"`
+	// SeriesLabels tell the series of a sub query apart from those of the other sub
+	// queries expanded from the same query, see expandQuery.
+	SeriesLabels data.Labels `json:"-"`
+
+	// GroupingFilterMapping and GroupingFilterIncludes are what the query editor sets,
+	// see resolveGroupingFilters.
+	GroupingFilterMapping  map[string]GroupingFilterMappingItem `json:"grouping_filter_mapping,omitempty"`
+	GroupingFilterIncludes map[string]bool                      `json:"grouping_filter_includes,omitempty"`
+}
+
+// upstreamQuery is what metrics/results and metrics/groupings are sent for a query,
+// the options the API knows about. The other options of a query are the plugin's.
+type upstreamQuery struct {
+	FilterId                   string                  `json:"filterId"`
+	StartTime                  string                  `json:"startTime"`
+	EndTime                    string                  `json:"endTime"`
+	GroupingFilters            *[]GroupingOrFilterItem `json:"groupingFilters"`
+	AggregationId              int                     `json:"aggregationId"`
+	Calculation                Calculation             `json:"calculation"`
+	LimitN                     *int                    `json:"limit"`
+	LimitType                  *LimitType              `json:"limitType"`
+	Alias                      string                  `json:"alias"`
+	ExcludeEmpty               bool                    `json:"excludeEmptyGroupings"`
+	Hide                       null.Bool               `json:"hide"`
+	FilterDefinitionName       string                  `json:"filterDefinitionName"`
+	LongResult                 null.Bool               `json:"longResult"`
+	IncludeGroupingLabels      bool                    `json:"includeGroupingLabels"`
+	SpecificGrouping           string                  `json:"groupingName"`
+	Mode                       string                  `json:"mode"`
+	IncludeAggregateOption     bool                    `json:"includeAggregateOption"`
+	IncludeIncompleteIntervals bool                    `json:"includeIncompleteIntervals"`
+	Percentile                 null.Float              `json:"percentile"`
+	Optimized                  bool                    `json:"optimized"`
+	QueryId                    string                  `json:"queryId"`
+	FastMode                   bool                    `json:"fast_mode"`
+	ShouldRecalculate          bool                    `json:"shouldRecalculate"`
+	RecalculatedInterval       *RecalculateInterval    `json:"recalculatedInterval"`
+}
+
+// upstream returns the options of qo the API is sent.
+func (qo QueryOptions) upstream() upstreamQuery {
+	return upstreamQuery{
+		FilterId:                   qo.FilterId,
+		StartTime:                  qo.StartTime,
+		EndTime:                    qo.EndTime,
+		GroupingFilters:            qo.GroupingFilters,
+		AggregationId:              qo.AggregationId,
+		Calculation:                qo.Calculation,
+		LimitN:                     qo.LimitN,
+		LimitType:                  qo.LimitType,
+		Alias:                      qo.Alias,
+		ExcludeEmpty:               qo.ExcludeEmpty,
+		Hide:                       qo.Hide,
+		FilterDefinitionName:       qo.FilterDefinitionName,
+		LongResult:                 qo.LongResult,
+		IncludeGroupingLabels:      qo.IncludeGroupingLabels,
+		SpecificGrouping:           qo.SpecificGrouping,
+		Mode:                       qo.Mode,
+		IncludeAggregateOption:     qo.IncludeAggregateOption,
+		IncludeIncompleteIntervals: qo.IncludeIncompleteIntervals,
+		Percentile:                 qo.Percentile,
+		Optimized:                  qo.Optimized,
+		QueryId:                    qo.QueryId,
+		FastMode:                   qo.FastMode,
+		ShouldRecalculate:          qo.ShouldRecalculate,
+		RecalculatedInterval:       qo.RecalculatedInterval,
+	}
 }
 
 type RecalculateInterval struct {
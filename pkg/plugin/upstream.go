@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy decides if and when a failed upstream call is attempted again.
+// Every endpoint we call only reads data, so all of them are safe to retry.
+type retryPolicy struct {
+	maxRetries    int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	maxRetryAfter time.Duration
+}
+
+// apiError is returned when the API answered with a non-200 status.
+type apiError struct {
+	// Path is the endpoint called, e.g. metrics/results.
+	Path       string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Error fetching %s %q / %q", e.Path, e.Status, string(e.Body))
+}
+
+// retryable reports whether a response with this status is worth another attempt.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// wait returns how long to sleep before retry number attempt (starting at 1). It uses
+// full jitter over an exponentially growing window, unless the server told us when to
+// come back. ok is false when the server asked us to wait longer than we are willing to.
+func (p retryPolicy) wait(attempt int, resp *http.Response) (d time.Duration, ok bool) {
+	if resp != nil {
+		if after, found := retryAfter(resp.Header.Get("Retry-After"), time.Now()); found {
+			return after, after <= p.maxRetryAfter
+		}
+	}
+	window := p.backoff << (attempt - 1)
+	if window > p.maxBackoff || window <= 0 {
+		window = p.maxBackoff
+	}
+	if window <= 0 {
+		return 0, true
+	}
+	return rand.N(window), true
+}
+
+// retryAfter parses a Retry-After header, which is either delay-seconds or an HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// doRequest calls an API endpoint with the token of the datasource, retrying network
+// errors and transient statuses per the instance's retry policy. payload may be nil.
+// Cancelling ctx aborts the call in flight as well as any pending retry.
+// The caller owns the body of the returned response.
+func (d *handler) doRequest(ctx context.Context, method string, path string, token string, payload []byte) (*http.Response, error) {
+	policy := d.config.RetryPolicy()
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		request, err := http.NewRequestWithContext(ctx, method, d.config.url(path), body)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("x-api-token", token)
+		request.Header.Set("Content-Type", "application/json")
+
+		http_response, err := d.httpClient.Do(request)
+		if ctx.Err() != nil || attempt >= policy.maxRetries || (err == nil && !retryable(http_response.StatusCode)) {
+			return http_response, err
+		}
+
+		sleep, ok := policy.wait(attempt+1, http_response)
+		if !ok {
+			return http_response, err
+		}
+		if http_response != nil {
+			io.Copy(io.Discard, http_response.Body)
+			http_response.Body.Close()
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newTestHandler returns a handler talking to a local stand-in server.
+func newTestHandler(t *testing.T, serverURL string) *handler {
+	return newTestHandlerWithSettings(t, `{"baseUrl":"`+serverURL+`","retryBackoffMs":1,"retryMaxBackoffMs":5}`)
+}
+
+// newTestHandlerWithSettings returns a handler configured with the given jsonData.
+func newTestHandlerWithSettings(t *testing.T, jsonData string) *handler {
+	t.Helper()
+	config, err := LoadSettings(backend.DataSourceInstanceSettings{JSONData: []byte(jsonData)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &handler{config: config, httpClient: &http.Client{Timeout: config.Timeout()}}
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			if r.Header.Get("x-api-token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := newTestHandler(t, srv.URL).doRequest(context.Background(), "POST", "metrics/results", "token", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 3 {
+		t.Fatalf("got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestDoRequestGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	resp, err := newTestHandler(t, srv.URL).doRequest(context.Background(), "GET", "organization/ping", "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 {
+		t.Fatalf("got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d, ok := retryAfter("2", now); !ok || d != 2*time.Second {
+		t.Errorf("seconds: got %v %v", d, ok)
+	}
+	if d, ok := retryAfter(now.Add(5*time.Second).Format(http.TimeFormat), now); !ok || d != 5*time.Second {
+		t.Errorf("date: got %v %v", d, ok)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("expected an invalid header to be ignored")
+	}
+}
+
+func TestAPIErrorNamesEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown grouping"))
+	}))
+	defer srv.Close()
+
+	res := newTestHandler(t, srv.URL).queryGroupings(context.Background(), "token", backend.PluginContext{}, backend.DataQuery{}, QueryOptions{FilterId: "f"})
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "metrics/groupings") {
+		t.Errorf("expected the error to name the endpoint, got %v", res.Error)
+	}
+}
@@ -0,0 +1,59 @@
+import React, { ChangeEvent } from 'react';
+import { QueryEditorProps } from '@grafana/data';
+import { InlineField, InlineFieldRow, InlineSwitch, Input, RadioButtonGroup, VerticalGroup } from '@grafana/ui';
+import { DataSource } from '../datasource';
+import { MyDataSourceOptions, MyQuery } from '../types';
+import { SharedEditor } from './SharedEditor';
+
+type Props = QueryEditorProps<DataSource, MyQuery, MyDataSourceOptions>;
+
+const conditions = [
+  { value: 'above', label: 'Above' },
+  { value: 'below', label: 'Below' },
+];
+
+// AnnotationEditor picks the aggregation compared to the threshold, and whether the
+// changes of the filter definition are marked too.
+export function AnnotationEditor(props: Props) {
+  const { query, onChange, onRunQuery } = props;
+  const onThresholdChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const num = parseFloat(event.target.value);
+    onChange({ ...query, threshold: isNaN(num) ? undefined : num });
+  };
+  const onConditionChange = (event: 'above' | 'below') => {
+    onChange({ ...query, condition: event });
+    onRunQuery();
+  };
+  const onDefinitionChangesChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, definitionChanges: event.target.checked || undefined });
+    onRunQuery();
+  };
+  return (
+    <VerticalGroup>
+      <InlineFieldRow>
+        <InlineField
+          label="Threshold"
+          labelWidth={15}
+          tooltip="Mark the periods where the aggregation of the query below crosses this value, per grouping"
+        >
+          <Input type="number" defaultValue={query.threshold} onChange={onThresholdChange} onBlur={onRunQuery} width={20} />
+        </InlineField>
+        <InlineField label="Condition" labelWidth={15}>
+          <RadioButtonGroup<'above' | 'below'>
+            value={query.condition || 'above'}
+            options={conditions as Array<{ value: 'above' | 'below'; label: string }>}
+            onChange={onConditionChange}
+          />
+        </InlineField>
+        <InlineField
+          label="Definition Changes"
+          labelWidth={22}
+          tooltip="Mark the changes of the filter definition, of every definition without a filter. Changes are the ones this Grafana instance saw when refetching the definitions since it started."
+        >
+          <InlineSwitch onChange={onDefinitionChangesChange} value={query.definitionChanges ?? false}></InlineSwitch>
+        </InlineField>
+      </InlineFieldRow>
+      <SharedEditor {...props} mode="query"></SharedEditor>
+    </VerticalGroup>
+  );
+}
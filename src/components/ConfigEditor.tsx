@@ -1,5 +1,5 @@
 import React, { ChangeEvent } from 'react';
-import { InlineField, SecretInput } from '@grafana/ui';
+import { InlineField, Input, SecretInput } from '@grafana/ui';
 import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
 import { MyDataSourceOptions, MySecureJsonData } from '../types';
 
@@ -32,7 +32,28 @@ export function ConfigEditor(props: Props) {
     });
   };
 
-  const { secureJsonFields } = options;
+  const onJsonDataChange = (key: 'baseUrl' | 'region' | 'apiVersion') => (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: event.target.value,
+      },
+    });
+  };
+
+  const onNumberChange = (key: 'timeoutSeconds' | 'maxRetries') => (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseInt(event.target.value, 10);
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...options.jsonData,
+        [key]: isNaN(value) ? undefined : value,
+      },
+    });
+  };
+
+  const { jsonData, secureJsonFields } = options;
   const secureJsonData = (options.secureJsonData || {}) as MySecureJsonData;
 
   return (
@@ -47,6 +68,26 @@ export function ConfigEditor(props: Props) {
           onChange={onAPIKeyChange}
         />
       </InlineField>
+      <InlineField label="Base URL" labelWidth={12} tooltip="Overrides the API host, e.g. a staging tenant. Leave empty for the public API.">
+        <Input
+          value={jsonData.baseUrl || ''}
+          placeholder="https://app.aggregations.io"
+          width={40}
+          onChange={onJsonDataChange('baseUrl')}
+        />
+      </InlineField>
+      <InlineField label="Region" labelWidth={12} tooltip="Regional deployment, ignored when a base URL is set.">
+        <Input value={jsonData.region || ''} placeholder="default" width={40} onChange={onJsonDataChange('region')} />
+      </InlineField>
+      <InlineField label="API Version" labelWidth={12}>
+        <Input value={jsonData.apiVersion || ''} placeholder="v1" width={40} onChange={onJsonDataChange('apiVersion')} />
+      </InlineField>
+      <InlineField label="Timeout" labelWidth={12} tooltip="Seconds allowed for a single request to the API.">
+        <Input type="number" value={jsonData.timeoutSeconds ?? ''} placeholder="10" width={40} onChange={onNumberChange('timeoutSeconds')} />
+      </InlineField>
+      <InlineField label="Max Retries" labelWidth={12} tooltip="Retries of failed requests (429, 502, 503, 504 and network errors). 0 disables retrying.">
+        <Input type="number" value={jsonData.maxRetries ?? ''} placeholder="2" width={40} onChange={onNumberChange('maxRetries')} />
+      </InlineField>
     </div>
   );
 }
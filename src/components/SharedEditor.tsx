@@ -26,6 +26,7 @@ import {
   Checkbox,
   InlineLabel,
   AsyncMultiSelect,
+  MultiSelect,
 } from '@grafana/ui';
 import { getTemplateSrv } from '@grafana/runtime';
 import { css } from '@emotion/css';
@@ -41,6 +42,34 @@ function selectable(value?: FilterDefinition | null): SelectableValue<FilterDefi
   return { label: value.name, value: value };
 }
 
+// query editor modes, the variable editor always uses 'variables'
+const queryModes = [
+  { value: 'query', label: 'Query' },
+  { value: 'ratio', label: 'Ratio', description: 'The aggregation divided by another aggregation of the filter, e.g. failed / all logins' },
+  { value: 'expression', label: 'Expression', description: 'Math over the other queries of the panel, e.g. ($A - $B) / $A * 100' },
+];
+
+// the frames a query returns, the default is a single wide or long frame
+const formatOptions = [
+  { value: '', label: 'Time series' },
+  { value: 'multi', label: 'Multi', description: 'A frame per series, labelled with its groupings' },
+  { value: 'numeric', label: 'Numeric', description: 'A single value per series, for stat panels and alert rules' },
+];
+
+const reducerOptions = [
+  { value: 'last', label: 'Last' },
+  { value: 'sum', label: 'Sum' },
+  { value: 'avg', label: 'Average' },
+  { value: 'max', label: 'Max' },
+  { value: 'min', label: 'Min' },
+];
+
+const divideByZeroOptions = [
+  { value: 'null', label: 'Null', description: 'Leave the point out' },
+  { value: 'zero', label: 'Zero' },
+  { value: 'inf', label: 'Infinity' },
+];
+
 const limitTypes = [
   { value: LimitType.Top, label: 'Top' },
   { value: LimitType.Bottom, label: 'Bottom' },
@@ -107,7 +136,7 @@ export class SharedEditor extends PureComponent<SharedProps> {
       datasourceId: props.datasource.id,
       excludeEmptyGroupings: false,
       includeGroupingLabels: cloned.includeGroupingLabels === undefined || this.props.query.includeGroupingLabels === null ? true : cloned.includeGroupingLabels,
-      mode: props.mode,
+      mode: props.mode === 'query' && queryModes.some((m) => m.value === cloned.mode) ? cloned.mode : props.mode,
     });
   }
   styles = getStyles();
@@ -122,6 +151,12 @@ export class SharedEditor extends PureComponent<SharedProps> {
       }>
   ) {
     //console.log('checking', props.query);
+    if (props.query.mode === 'expression') {
+      if (props.query.expression && props.query.expression.trim() !== '') {
+        this.props.onRunQuery();
+      }
+      return;
+    }
     if (
       props.query.filter_definition &&
       props.query.filter_definition !== null &&
@@ -136,6 +171,15 @@ export class SharedEditor extends PureComponent<SharedProps> {
         }
       }
     }
+    if (
+      props.query.mode === 'ratio' &&
+      (!props.query.ratio ||
+        !props.query.ratio.denominatorAggregationId ||
+        (this.getDenominatorCalculation() === Calculation.Percentiles &&
+          (props.query.ratio.denominatorPercentile ?? props.query.percentile ?? 0) <= 0))
+    ) {
+      return;
+    }
     if (
       props.query.filterId &&
       props.query.filterId !== '' &&
@@ -242,7 +286,10 @@ export class SharedEditor extends PureComponent<SharedProps> {
       filter_definition: event.value!,
       selected_agg: sel_fd_agg,
       aggregationId: sel_fd_agg == null ? null : sel_fd_agg.id,
+      aggregationIds: undefined,
       calculation: sel_agg,
+      calculations: undefined,
+      percentiles: undefined,
       filterDefinitionName: event.value!.name,
       grouping_filter_mapping: {},
       grouping_filter_mapping_str: '',
@@ -275,7 +322,21 @@ export class SharedEditor extends PureComponent<SharedProps> {
         new_agg = event.value!.calculations[0];
       }
     }
-    onChange({ ...query, aggregationId: event.value!.id, selected_agg: event.value!, calculation: new_agg });
+    const more = (query.aggregationIds || []).slice(1).filter((x) => x !== event.value!.id);
+    onChange({
+      ...query,
+      aggregationId: event.value!.id,
+      aggregationIds: more.length > 0 ? [event.value!.id, ...more] : undefined,
+      selected_agg: event.value!,
+      calculation: new_agg,
+      calculations: undefined,
+    });
+  };
+  // the aggregations beyond the first one, aggregationIds replaces aggregationId once set
+  onMoreAggregationsChange = (event: Array<SelectableValue<FilterDefinitionAggregation>>) => {
+    const { onChange, query } = this.props;
+    const more = event.map((x) => x.value!.id).filter((x) => x !== query.aggregationId);
+    onChange({ ...query, aggregationIds: more.length > 0 && query.aggregationId != null ? [query.aggregationId, ...more] : undefined });
   };
 
   getCalculationOptions(): Array<SelectableValue<Calculation>> {
@@ -287,16 +348,33 @@ export class SharedEditor extends PureComponent<SharedProps> {
 
   onAggChange = (event: SelectableValue<Calculation>) => {
     const { onChange, query } = this.props;
-    onChange({ ...query, calculation: event.value! });
+    const more = (query.calculations || []).slice(1).filter((x) => x !== event.value);
+    onChange({ ...query, calculation: event.value!, calculations: more.length > 0 ? [event.value!, ...more] : undefined });
+  };
+  // the calculations beyond the first one, calculations replaces calculation once set
+  onMoreCalculationsChange = (event: Array<SelectableValue<Calculation>>) => {
+    const { onChange, query } = this.props;
+    const more = event.map((x) => x.value!).filter((x) => x !== query.calculation);
+    onChange({ ...query, calculations: more.length > 0 && query.calculation !== null ? [query.calculation, ...more] : undefined });
+  };
+  // the percentiles beyond the first one, percentiles replaces percentile once set
+  onMorePercentilesChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    const more = event.target.value
+      .split(',')
+      .map((x) => parseFloat(x))
+      .filter((x) => !isNaN(x) && x !== query.percentile);
+    onChange({ ...query, percentiles: more.length > 0 && query.percentile !== null ? [query.percentile, ...more] : undefined });
   };
   onPercentileChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onChange, query } = this.props;
     try {
       if (event.target.value.trim() !== '') {
         let num = parseFloat(event.target.value);
-        onChange({ ...query, percentile: num });
+        const more = (query.percentiles || []).slice(1).filter((x) => x !== num);
+        onChange({ ...query, percentile: num, percentiles: more.length > 0 ? [num, ...more] : undefined });
       } else {
-        onChange({ ...query, percentile: null });
+        onChange({ ...query, percentile: null, percentiles: undefined });
       }
     } catch { }
   };
@@ -321,6 +399,87 @@ export class SharedEditor extends PureComponent<SharedProps> {
       }
     } catch { }
   };
+  onLegendFormatChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, legendFormat: event.target.value.trim() !== '' ? event.target.value : undefined });
+  };
+  onModeChange = (event: string) => {
+    const { onChange, query } = this.props;
+    if (event === 'ratio') {
+      // ratios take a single aggregation and calculation
+      onChange({ ...query, mode: event, aggregationIds: undefined, calculations: undefined, percentiles: undefined });
+      return;
+    }
+    onChange({ ...query, mode: event });
+  };
+  getDenominatorAgg(): FilterDefinitionAggregation | undefined {
+    const id = this.props.query.ratio?.denominatorAggregationId;
+    return this.props.query.filter_definition?.aggregations.find((x) => x.id === id);
+  }
+  // the calculation of the denominator, the one of the query unless set
+  getDenominatorCalculation(): Calculation | null {
+    return this.props.query.ratio?.denominatorCalculation || this.props.query.calculation;
+  }
+  onDenominatorAggChange = (event: SelectableValue<FilterDefinitionAggregation>) => {
+    const { onChange, query } = this.props;
+    const calculation = query.ratio?.denominatorCalculation;
+    onChange({
+      ...query,
+      ratio: {
+        ...query.ratio,
+        denominatorAggregationId: event.value!.id,
+        denominatorCalculation: calculation && event.value!.calculations.includes(calculation) ? calculation : undefined,
+      },
+    });
+  };
+  onDenominatorCalculationChange = (event: SelectableValue<Calculation>) => {
+    const { onChange, query } = this.props;
+    onChange({
+      ...query,
+      ratio: {
+        ...query.ratio!,
+        denominatorCalculation: event.value === query.calculation ? undefined : event.value,
+      },
+    });
+  };
+  onDenominatorPercentileChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    const num = parseFloat(event.target.value);
+    onChange({ ...query, ratio: { ...query.ratio!, denominatorPercentile: isNaN(num) ? undefined : num } });
+  };
+  onDivideByZeroChange = (event: 'null' | 'zero' | 'inf') => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, ratio: { ...query.ratio!, divideByZero: event } });
+    this.onRunQuery(this.props);
+  };
+  onScaleChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    const num = parseFloat(event.target.value);
+    onChange({ ...query, ratio: { ...query.ratio!, scale: isNaN(num) ? undefined : num } });
+  };
+  onExpressionChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, expression: event.target.value.trim() !== '' ? event.target.value : undefined });
+  };
+  onFormatChange = (event: string) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, format: event === '' ? undefined : (event as 'multi' | 'numeric') });
+    this.onRunQuery(this.props);
+  };
+  onReducerChange = (event: SelectableValue<string>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, reducer: event?.value as MyQuery['reducer'] });
+  };
+  onStreamChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, stream: event.target.checked || undefined });
+    this.onRunQuery(this.props);
+  };
+  onInstantChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, instant: event.target.checked || undefined });
+    this.onRunQuery(this.props);
+  };
   onLimitTypeChange = (event: LimitType) => {
     const { onChange, query } = this.props;
     onChange({ ...query, limitType: event });
@@ -356,6 +515,11 @@ export class SharedEditor extends PureComponent<SharedProps> {
     onChange({ ...query, includeGroupingLabels: event.target.checked });
     this.onRunQuery(this.props);
   };
+  onGroupingAliasChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, useGroupingAliases: event.target.checked });
+    this.onRunQuery(this.props);
+  };
   onSpecificGroupingChange = (event: SelectableValue<string>) => {
     const { onChange, query } = this.props;
     onChange({ ...query, groupingName: event.value || null });
@@ -417,6 +581,53 @@ export class SharedEditor extends PureComponent<SharedProps> {
   }
 
   render() {
+    let mode_field = (
+      <InlineFieldRow>
+        <InlineField label="Type" labelWidth={15}>
+          <RadioButtonGroup<string> value={this.props.query.mode || 'query'} options={queryModes} onChange={this.onModeChange} />
+        </InlineField>
+      </InlineFieldRow>
+    );
+    if (this.this_is_query_editor && this.props.query.mode === 'expression') {
+      return (
+        <div className="upper">
+          <VerticalGroup>
+            {mode_field}
+            <InlineFieldRow>
+              <InlineField
+                label="Expression"
+                labelWidth={15}
+                tooltip={
+                  'Refer to other queries by refId, e.g. ($A - $B) / $A * 100. Series are matched on their labels, restrict the labels matched on with on(os) or ignoring(calculation).'
+                }
+              >
+                <Input
+                  type="text"
+                  value={this.props.query.expression || undefined}
+                  placeholder="($A - $B) / $A * 100"
+                  onChange={this.onExpressionChange}
+                  onBlur={() => {
+                    this.onRunQuery(this.props);
+                  }}
+                  width={60}
+                />
+              </InlineField>
+              <InlineField label="Alias" labelWidth={15}>
+                <Input
+                  type="text"
+                  value={this.props.query.alias || undefined}
+                  onChange={this.onAliasChange}
+                  onBlur={() => {
+                    this.onRunQuery(this.props);
+                  }}
+                  width={30}
+                />
+              </InlineField>
+            </InlineFieldRow>
+          </VerticalGroup>
+        </div>
+      );
+    }
     const show_grouping_ops =
       this.this_is_query_editor &&
       this.props.query.filter_definition &&
@@ -471,6 +682,16 @@ export class SharedEditor extends PureComponent<SharedProps> {
               value={this.props.query.includeGroupingLabels === null ? false : this.props.query.includeGroupingLabels}
             ></InlineSwitch>
           </InlineField>
+          <InlineField
+            label="Grouping Aliases"
+            labelWidth={20}
+            tooltip={'Name grouping columns and labels after the aliases of the filter definition instead of their keys'}
+          >
+            <InlineSwitch
+              onChange={this.onGroupingAliasChange}
+              value={this.props.query.useGroupingAliases ?? false}
+            ></InlineSwitch>
+          </InlineField>
         </InlineFieldRow>
       );
       let variables = getTemplateSrv()
@@ -631,6 +852,7 @@ export class SharedEditor extends PureComponent<SharedProps> {
           <div style={{ width: '95%' }}>
             {/* width={this.props.query.filter_definition && this.props.query.filter_definition.groupings && this.props.query.filter_definition.groupings.length > 0 ? '60%' : '100%'} */}
             <VerticalGroup>
+              {this.this_is_query_editor && mode_field}
               {!this.this_is_query_editor && <InlineFieldRow>{filter_field}</InlineFieldRow>}
               <InlineFieldRow>
                 {this.this_is_query_editor && filter_field}
@@ -683,6 +905,23 @@ export class SharedEditor extends PureComponent<SharedProps> {
                     />
                   </InlineField>
                 )}
+                {this.this_is_query_editor && this.props.query.mode !== 'ratio' && this.props.query.selected_agg && this.getFDAggs().length > 1 && (
+                  <InlineField
+                    label="More Aggregations"
+                    labelWidth={18}
+                    tooltip="Additional aggregations of the filter with the same calculation, each returned as its own series labelled with its aggregation"
+                  >
+                    <MultiSelect<FilterDefinitionAggregation>
+                      options={this.getFDAggs().filter((x) => x.value!.id !== this.props.query.aggregationId)}
+                      value={this.getFDAggs().filter((x) => (this.props.query.aggregationIds || []).slice(1).includes(x.value!.id))}
+                      onChange={this.onMoreAggregationsChange}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={50}
+                    />
+                  </InlineField>
+                )}
               </InlineFieldRow>
               <InlineFieldRow>
                 {this.this_is_query_editor && this.props.query != null && (
@@ -725,7 +964,114 @@ export class SharedEditor extends PureComponent<SharedProps> {
                       />
                     </InlineField>
                   )}
+                {this.this_is_query_editor &&
+                  this.props.query.mode !== 'ratio' &&
+                  this.props.query?.calculation === Calculation.Percentiles && (
+                    <InlineField
+                      label="More Percentiles"
+                      tooltip="Additional percentiles as a comma separated list, e.g. '0.5, 0.9', each returned as its own series"
+                      labelWidth={18}
+                    >
+                      <Input
+                        type="text"
+                        defaultValue={(this.props.query.percentiles || []).slice(1).join(', ')}
+                        placeholder="0.5, 0.9"
+                        onChange={this.onMorePercentilesChange}
+                        width={20}
+                        onBlur={() => {
+                          this.onRunQuery(this.props);
+                        }}
+                      />
+                    </InlineField>
+                  )}
               </InlineFieldRow>
+              {this.this_is_query_editor && this.props.query.mode !== 'ratio' && this.props.query.calculation !== null && this.getCalculationOptions().length > 1 && (
+                <InlineFieldRow>
+                  <InlineField
+                    label="More Calculations"
+                    labelWidth={18}
+                    tooltip="Additional calculations of the aggregation, each returned as its own series labelled with its calculation"
+                  >
+                    <MultiSelect<Calculation>
+                      options={this.getCalculationOptions().filter((x) => x.value !== this.props.query.calculation)}
+                      value={(this.props.query.calculations || []).slice(1)}
+                      onChange={this.onMoreCalculationsChange}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={50}
+                    />
+                  </InlineField>
+                </InlineFieldRow>
+              )}
+              {this.this_is_query_editor && this.props.query.mode === 'ratio' && (
+                <InlineFieldRow>
+                  <InlineField label="Denominator" labelWidth={15} tooltip="The aggregation the query is divided by">
+                    <Select
+                      allowCustomValue={false}
+                      value={selectableFDAgg(this.getDenominatorAgg())}
+                      onChange={this.onDenominatorAggChange}
+                      options={this.getFDAggs()}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={30}
+                    />
+                  </InlineField>
+                  <InlineField label="Calculation" labelWidth={15} tooltip="Defaults to the calculation of the query">
+                    <Select
+                      allowCustomValue={false}
+                      value={selectableCalculation(this.getDenominatorCalculation())}
+                      onChange={this.onDenominatorCalculationChange}
+                      options={(this.getDenominatorAgg()?.calculations || []).map((x) => selectableCalculation(x))}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={this.getDenominatorCalculation() === Calculation.Percentiles ? 20 : 30}
+                    />
+                  </InlineField>
+                  {this.getDenominatorCalculation() === Calculation.Percentiles && (
+                    <InlineField label="Percentile" labelWidth={15} tooltip="Defaults to the percentile of the query">
+                      <Input
+                        type="number"
+                        min="0"
+                        max="1"
+                        step="0.05"
+                        defaultValue={this.props.query.ratio?.denominatorPercentile}
+                        placeholder={this.props.query.percentile == null ? undefined : String(this.props.query.percentile)}
+                        onChange={this.onDenominatorPercentileChange}
+                        onBlur={() => {
+                          this.onRunQuery(this.props);
+                        }}
+                        width={20}
+                      />
+                    </InlineField>
+                  )}
+                </InlineFieldRow>
+              )}
+              {this.this_is_query_editor && this.props.query.mode === 'ratio' && (
+                <InlineFieldRow>
+                  <InlineField label="Divide by Zero" labelWidth={15} tooltip="What the ratio is when the denominator is 0">
+                    <RadioButtonGroup<'null' | 'zero' | 'inf'>
+                      value={this.props.query.ratio?.divideByZero || 'null'}
+                      options={divideByZeroOptions as Array<SelectableValue<'null' | 'zero' | 'inf'>>}
+                      onChange={this.onDivideByZeroChange}
+                    />
+                  </InlineField>
+                  <InlineField label="Scale" labelWidth={15} tooltip="Multiplies the ratio, 100 for a percentage">
+                    <Input
+                      type="number"
+                      defaultValue={this.props.query.ratio?.scale}
+                      placeholder="1"
+                      onChange={this.onScaleChange}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={15}
+                    />
+                  </InlineField>
+                </InlineFieldRow>
+              )}
               {this.this_is_query_editor && (
                 <InlineFieldRow>
                   <InlineField
@@ -772,6 +1118,70 @@ export class SharedEditor extends PureComponent<SharedProps> {
                       width={50}
                     />
                   </InlineField>
+                  <InlineField
+                    label="Legend"
+                    labelWidth={15}
+                    tooltip={
+                      'Series name template, e.g. {{os}} / {{country}} ({{__calc}}). Builtins: __alias, __name, __filter, __aggregation, __calc, __percentile. Use {{label|fallback}} for series without the label.'
+                    }
+                  >
+                    <Input
+                      type="text"
+                      value={this.props.query.legendFormat || undefined}
+                      placeholder="{{os}} ({{__calc}})"
+                      onChange={this.onLegendFormatChange}
+                      onBlur={() => {
+                        this.onRunQuery(this.props);
+                      }}
+                      width={40}
+                    />
+                  </InlineField>
+                </InlineFieldRow>
+              )}
+              {this.this_is_query_editor && (
+                <InlineFieldRow>
+                  <InlineField label="Format" labelWidth={15}>
+                    <RadioButtonGroup<string>
+                      value={this.props.query.format || ''}
+                      options={formatOptions}
+                      onChange={this.onFormatChange}
+                    />
+                  </InlineField>
+                  <InlineField
+                    label="Instant"
+                    labelWidth={15}
+                    tooltip="A single value per series over the whole range, as a table keyed by the groupings"
+                  >
+                    <InlineSwitch onChange={this.onInstantChange} value={this.props.query.instant ?? false}></InlineSwitch>
+                  </InlineField>
+                  {this.props.query.mode === 'query' && (
+                    <InlineField
+                      label="Stream"
+                      labelWidth={15}
+                      tooltip="Keep the panel updated over Grafana Live, the query is polled every interval and returned as a long table"
+                    >
+                      <InlineSwitch onChange={this.onStreamChange} value={this.props.query.stream ?? false}></InlineSwitch>
+                    </InlineField>
+                  )}
+                  {(this.props.query.format === 'numeric' || this.props.query.instant) && (
+                    <InlineField
+                      label="Reducer"
+                      labelWidth={15}
+                      tooltip="How the points of a series are reduced to a single value. Instant queries without one are aggregated over the range by the API."
+                    >
+                      <Select
+                        allowCustomValue={false}
+                        value={this.props.query.reducer || (this.props.query.instant ? undefined : 'last')}
+                        isClearable={this.props.query.instant}
+                        onChange={this.onReducerChange}
+                        options={reducerOptions}
+                        onBlur={() => {
+                          this.onRunQuery(this.props);
+                        }}
+                        width={20}
+                      />
+                    </InlineField>
+                  )}
                 </InlineFieldRow>
               )}
               {grouping_ops}
@@ -6,11 +6,15 @@ import {
   DataQueryRequest,
   ScopedVars,
   VariableWithOptions,
+  DataQueryResponse,
+  LiveChannelScope,
 } from '@grafana/data';
-import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
+import { DataSourceWithBackend, getGrafanaLiveSrv, getTemplateSrv } from '@grafana/runtime';
+import { Observable, merge } from 'rxjs';
 
 import { MyQuery, MyDataSourceOptions, DEFAULT_QUERY, FilterDefinition, GroupingFilterItem } from './types';
 import { VariableEditor } from 'components/VariableEditor';
+import { AnnotationEditor } from 'components/AnnotationEditor';
 import { uniqueId } from 'lodash';
 
 export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptions> {
@@ -27,6 +31,45 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
         return this.query({ ...request, targets: queries });
       },
     };
+
+    this.annotations = {
+      QueryEditor: AnnotationEditor,
+      prepareQuery: (anno) => {
+        if (!anno.target) {
+          return undefined;
+        }
+        return { ...anno.target, refId: anno.target.refId || 'Anno', queryType: 'annotations' };
+      },
+    };
+  }
+
+  // streamed queries subscribe to a channel of the backend polling them, which
+  // backfills the range of the panel, the others run as usual
+  query(request: DataQueryRequest<MyQuery>): Observable<DataQueryResponse> {
+    const streamed = request.targets.filter((q) => q.stream && !q.hide && (!q.mode || q.mode === 'query'));
+    if (streamed.length === 0) {
+      return super.query(request);
+    }
+    const others = request.targets.filter((q) => !streamed.includes(q));
+    const streams = streamed.map((q) => {
+      const data = {
+        ...this.applyTemplateVariables({ ...q }, request.scopedVars),
+        intervalMs: request.intervalMs,
+        from: request.range.from.valueOf(),
+      };
+      return getGrafanaLiveSrv().getDataStream({
+        key: `${request.requestId}-${q.refId}`,
+        addr: {
+          scope: LiveChannelScope.DataSource,
+          namespace: this.uid,
+          // queries sharing a channel share their data, the path tells them apart
+          path: `query/${q.refId}-${hashQuery(data)}`,
+          data,
+        },
+        buffer: { maxDelta: request.range.to.valueOf() - request.range.from.valueOf() },
+      });
+    });
+    return others.length > 0 ? merge(super.query({ ...request, targets: others }), ...streams) : merge(...streams);
   }
 
   applyTemplateVariables(query: MyQuery, scopedVars: ScopedVars): MyQuery {
@@ -100,8 +143,11 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
     };
     return interpolatedQuery;
   }
-  async getFilterDefinitions(): Promise<FilterDefinition[]> {
-    return this.getResource('filterDefinitions');
+  async getFilterDefinitions(refresh = false): Promise<FilterDefinition[]> {
+    return this.getResource('filterDefinitions', refresh ? { refresh: 'true' } : undefined);
+  }
+  async invalidateFilterDefinitions(): Promise<void> {
+    return this.postResource('filterDefinitions/invalidate');
   }
   getDefaultQuery(_: CoreApp): Partial<MyQuery> {
     return DEFAULT_QUERY;
@@ -116,3 +162,14 @@ export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptio
     return results;
   }
 }
+
+// hashQuery returns a short hash of the JSON of a query, channel paths are limited in
+// length and characters.
+function hashQuery(query: object): string {
+  const json = JSON.stringify(query);
+  let hash = 0;
+  for (let i = 0; i < json.length; i++) {
+    hash = (Math.imul(31, hash) + json.charCodeAt(i)) | 0;
+  }
+  return (hash >>> 0).toString(36);
+}
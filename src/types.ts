@@ -9,7 +9,9 @@ export enum LimitType {
 export interface MyQuery extends DataQuery {
   filterId: string | null;
   aggregationId: number | null;
+  aggregationIds?: number[];
   calculation: Calculation | null;
+  calculations?: Calculation[];
   limit: number | null;
   limitType: LimitType | null;
   //groupingFilters: { [key: string]: string[] } | null;
@@ -24,15 +26,36 @@ export interface MyQuery extends DataQuery {
   excludeEmptyGroupings: boolean;
   filterDefinitionName: string | null;
   longResult: boolean;
+  format?: 'multi' | 'numeric';
+  reducer?: 'last' | 'sum' | 'avg' | 'max' | 'min';
+  instant?: boolean;
+  // stream keeps the panel updated over Grafana Live, polling every interval
+  stream?: boolean;
   includeGroupingLabels: boolean | null;
+  useGroupingAliases?: boolean;
+  legendFormat?: string;
   mode: string;
   groupingName: string | null;
   includeAggregateOption: boolean;
   rand_id: string;
   includeIncompleteIntervals: boolean;
   percentile: number | null;
+  percentiles?: number[];
   fast_mode: boolean;
   shouldRecalculate: boolean;
+  ratio?: RatioOptions;
+  expression?: string;
+  threshold?: number;
+  condition?: 'above' | 'below';
+  definitionChanges?: boolean;
+}
+
+export interface RatioOptions {
+  denominatorAggregationId: number;
+  denominatorCalculation?: Calculation;
+  denominatorPercentile?: number;
+  divideByZero?: 'null' | 'zero' | 'inf';
+  scale?: number;
 }
 
 
@@ -62,6 +85,20 @@ export const DEFAULT_QUERY: Partial<MyQuery> = {
  */
 export interface MyDataSourceOptions extends DataSourceJsonData {
   path?: string;
+  baseUrl?: string;
+  region?: string;
+  apiVersion?: string;
+  timeoutSeconds?: number;
+  maxRetries?: number;
+  retryBackoffMs?: number;
+  retryMaxBackoffMs?: number;
+  maxRetryAfterSeconds?: number;
+  filterDefinitionCacheSeconds?: number;
+  resultCacheSeconds?: number;
+  incompleteResultCacheSeconds?: number;
+  incrementalCacheSeconds?: number;
+  maxBatchSize?: number;
+  maxConcurrentQueries?: number;
 }
 
 export interface Items {